@@ -1,32 +1,234 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // Config holds the application configuration
 type Config struct {
-	Network string        // Docker network to monitor
-	OutFile string        // Output file for Caddy configuration
-	Notify  *NotifyConfig // Notification configuration
+	Network   string         // Docker network to monitor
+	OutFile   string         // Output file for Caddy configuration
+	L4OutFile string         // Output file for the layer4 app, disabled if empty
+	Mode      string         // Output mode, either ModeHandle or ModeSite
+	Notify    []NotifyConfig // Notifiers run in order after the configuration changed
+
+	ReloadInterval int // Minimum seconds between two reloads, changes in between are folded into one reload
+
+	TLSIssuers map[string]TLSIssuer // Named ACME issuers referenced by the virtual.tls label
+
+	DefaultDomain string // Domain available as {domain} in hostname templates
+	DefaultHost   string // Hostname template for binds without hostnames
+
+	AutoExpose bool           // Expose containers without virtual.bind label on their only TCP port
+	ImagePorts map[string]int // Default ports per image, used when the port is inferred
+
+	Filter *FilterConfig // Rules selecting the containers managed by caddy-gen
+
+	Endpoints    []EndpointConfig // Docker endpoints to watch, defaults to the environment
+	HostAddress  string           // Address of the Docker host for containers outside the network, defaults to its gateway
+	IPPreference string           // Address family of upstreams, IPv4, IPv6 or Dual
+
+	SecretsDir string // Directory of secret files in addition to the Docker secrets
+
+	Policy *PolicyConfig // Directives allowed in labels
+
+	Ownership []OwnershipRule // Rules restricting who can claim hostnames
+
+	AuthProviders map[string]AuthProvider // Named authentication providers referenced by the virtual.auth label
+	Snippets      map[string][]string     // Named directive bundles referenced by snippet directives
+
+	Maintenance *MaintenanceConfig // Responses for stopped containers and upstream failures, disabled if nil
+	Waker       *WakerConfig       // Endpoint starting stopped containers on demand, disabled if nil
 }
 
-// NotifyConfig represents the notification configuration
+const (
+	// ModeHandle emits one handle block per host group, to be imported inside a wildcard site
+	ModeHandle = "handle"
+	// ModeSite emits one full site block per hostname, to be imported at the top level
+	ModeSite = "site"
+)
+
+const (
+	// IPv4 prefers the IPv4 address of containers and falls back to IPv6
+	IPv4 = "ipv4"
+	// IPv6 prefers the IPv6 address of containers and falls back to IPv4
+	IPv6 = "ipv6"
+	// Dual uses both addresses of dual-stack containers as upstreams
+	Dual = "dual"
+)
+
+// NotifyConfig represents a notifier run after the configuration changed
 type NotifyConfig struct {
-	ContainerID string   `json:"containerId"`
-	WorkingDir  string   `json:"workingDir"`
-	Command     []string `json:"command"`
+	Type        string            `json:"type"`        // One of the Notify* types, inferred from the other fields if empty
+	ContainerID string            `json:"containerId"` // Container to run the command in or to signal, for exec and signal
+	WorkingDir  string            `json:"workingDir"`  // Working directory of the command, for exec and command
+	Command     []string          `json:"command"`     // Command to run, for exec and command, defaults to caddy reload
+	User        string            `json:"user"`        // User running the command, for exec
+	Env         []string          `json:"env"`         // Additional environment variables (KEY=VALUE), for exec and command
+	Signal      string            `json:"signal"`      // Signal sent to the container, e.g. SIGUSR1, for signal
+	URL         string            `json:"url"`         // URL to request, for http
+	Method      string            `json:"method"`      // Method of the request, for http, defaults to POST
+	Headers     map[string]string `json:"headers"`     // Headers of the request, for http
+	Body        string            `json:"body"`        // Body of the request, for http
+	Timeout     int               `json:"timeout"`     // Seconds before an attempt is aborted, defaults to 10
+	Retries     int               `json:"retries"`     // Attempts after a failed one
+	Success     []int             `json:"success"`     // Exit codes or HTTP statuses of success, defaults to 0 or any 2xx
 }
 
-// NewConfig creates a new Config instance with values from environment variables
-func NewConfig() *Config {
-	return &Config{
-		Network: GetEnv("CADDY_GEN_NETWORK", "gateway"),
-		OutFile: GetEnv("CADDY_GEN_OUTFILE", "docker-sites.caddy"),
-		Notify:  ParseNotifyConfig(GetEnv("CADDY_GEN_NOTIFY", "")),
+const (
+	// NotifyExec runs a command in a container
+	NotifyExec = "exec"
+	// NotifySignal sends a signal to a container
+	NotifySignal = "signal"
+	// NotifyHTTP sends an HTTP request
+	NotifyHTTP = "http"
+	// NotifyCommand runs a local command
+	NotifyCommand = "command"
+)
+
+// TLSIssuer represents a named ACME issuer that labels can refer to
+type TLSIssuer struct {
+	Email     string   `json:"email"`
+	CA        string   `json:"ca"`
+	DNS       string   `json:"dns"`
+	Resolvers []string `json:"resolvers"`
+}
+
+// FilterConfig represents the rules selecting which containers are managed
+type FilterConfig struct {
+	Labels          []string `json:"labels"`          // Label selectors (KEY or KEY=VALUE) that must all match
+	ExcludeLabels   []string `json:"excludeLabels"`   // Label selectors that exclude a container if any matches
+	Names           []string `json:"names"`           // Name patterns of which at least one must match
+	ExcludeNames    []string `json:"excludeNames"`    // Name patterns that exclude a container if any matches
+	Projects        []string `json:"projects"`        // Compose projects that are allowed
+	ExcludeProjects []string `json:"excludeProjects"` // Compose projects that are denied
+}
+
+// EndpointConfig represents a Docker endpoint to watch
+type EndpointConfig struct {
+	Name      string `json:"name"`      // Name of the endpoint in logs
+	Host      string `json:"host"`      // Docker host, e.g. unix:///var/run/docker.sock or tcp://10.0.0.2:2376
+	Context   string `json:"context"`   // Docker context to read the host and TLS files from
+	TLSCACert string `json:"tlsCaCert"` // CA certificate for TCP+TLS hosts
+	TLSCert   string `json:"tlsCert"`   // Client certificate for TCP+TLS hosts
+	TLSKey    string `json:"tlsKey"`    // Client key for TCP+TLS hosts
+	Address   string `json:"address"`   // Address of the host to reach published ports, if not on the network
+	Network   string `json:"network"`   // Docker network to monitor, defaults to CADDY_GEN_NETWORK
+}
+
+// PolicyConfig represents the directives allowed in labels, per scope and per compose project
+type PolicyConfig struct {
+	Host     *DirectiveRules          `json:"host"`     // Rules for host: directives
+	Proxy    *DirectiveRules          `json:"proxy"`    // Rules for reverse_proxy directives
+	Projects map[string]*PolicyConfig `json:"projects"` // Rules replacing the defaults for a compose project
+	Secrets  []SecretRule             `json:"secrets"`  // Rules of the secrets labels can reference, all secrets if nil
+	Sockets  []string                 `json:"sockets"`  // Directories of the Unix sockets labels can proxy to, none if empty
+}
+
+// SecretRule allows some containers to reference the secrets matching a pattern
+type SecretRule struct {
+	Secrets  []string `json:"secrets"`  // Secret name patterns, * matches any characters
+	Projects []string `json:"projects"` // Compose projects allowed to reference the secrets
+	Labels   []string `json:"labels"`   // Label selectors (KEY or KEY=VALUE) of allowed containers
+	Names    []string `json:"names"`    // Name patterns of allowed containers
+}
+
+// DirectiveRules represents allowed and denied directive names
+type DirectiveRules struct {
+	Allow []string `json:"allow"` // If not empty, only these directives are allowed
+	Deny  []string `json:"deny"`  // Directives that are never allowed, also inside blocks
+}
+
+// OwnershipRule restricts the hostnames matching a pattern to some owners
+type OwnershipRule struct {
+	Hosts    []string `json:"hosts"`    // Hostname patterns, * matches any characters
+	Projects []string `json:"projects"` // Compose projects owning the hostnames
+	Labels   []string `json:"labels"`   // Label selectors (KEY or KEY=VALUE) of owners
+	Names    []string `json:"names"`    // Name patterns of owners
+}
+
+// AuthProvider represents a named authentication provider that labels can refer to
+type AuthProvider struct {
+	Type        string   `json:"type"`        // Either forward_auth or basic_auth
+	URL         string   `json:"url"`         // Upstream of the authentication service, for forward_auth
+	URI         string   `json:"uri"`         // URI of the authentication endpoint, for forward_auth
+	CopyHeaders []string `json:"copyHeaders"` // Headers copied from the authentication response, for forward_auth
+	UsersFile   string   `json:"usersFile"`   // Secret file with one "USER HASH" per line, for basic_auth
+}
+
+// MaintenanceConfig represents the responses served for stopped containers and upstream failures
+type MaintenanceConfig struct {
+	Status int    `json:"status"` // Status of the maintenance response, defaults to 503
+	Body   string `json:"body"`   // Body of the maintenance and error responses
+	Root   string `json:"root"`   // Directory of error pages named after status codes, e.g. 503.html, used instead of body
+}
+
+// WakerConfig represents the endpoint starting stopped containers on their first request
+type WakerConfig struct {
+	Listen   string `json:"listen"`   // Address the waker listens on, defaults to :8090
+	Upstream string `json:"upstream"` // Address Caddy reaches the waker at, e.g. caddy-gen:8090
+	Timeout  int    `json:"timeout"`  // Seconds to wait for a container to become healthy, defaults to 60
+	Token    string `json:"token"`    // Secret Caddy sends with forwarded requests, random if empty
+}
+
+// NewConfig creates a new Config instance with values from environment variables,
+// invalid security settings are errors so they never fall back to allowing everything
+func NewConfig() (*Config, error) {
+	policy, err := ParsePolicyConfig(GetEnv("CADDY_GEN_POLICY", ""))
+	if err != nil {
+		return nil, err
+	}
+	ownership, err := ParseOwnership(GetEnv("CADDY_GEN_OWNERSHIP", ""))
+	if err != nil {
+		return nil, err
+	}
+	// An invalid filter would select all containers of a shared host
+	filter, err := ParseFilterConfig(GetEnv("CADDY_GEN_FILTER", ""))
+	if err != nil {
+		return nil, err
 	}
+	return &Config{
+		Network:   GetEnv("CADDY_GEN_NETWORK", "gateway"),
+		OutFile:   GetEnv("CADDY_GEN_OUTFILE", "docker-sites.caddy"),
+		L4OutFile: GetEnv("CADDY_GEN_L4_OUTFILE", ""),
+		Mode:      ParseMode(GetEnv("CADDY_GEN_MODE", ModeHandle)),
+		Notify:    ParseNotifyConfig(GetEnv("CADDY_GEN_NOTIFY", "")),
+
+		ReloadInterval: GetEnvInt("CADDY_GEN_RELOAD_INTERVAL", 5),
+
+		TLSIssuers: ParseTLSIssuers(GetEnv("CADDY_GEN_TLS_ISSUERS", "")),
+
+		DefaultDomain: GetEnv("CADDY_GEN_DEFAULT_DOMAIN", ""),
+		DefaultHost:   GetEnv("CADDY_GEN_DEFAULT_HOST", "{service}.{project}.{domain}"),
+
+		AutoExpose: GetEnvBool("CADDY_GEN_AUTO_EXPOSE", false),
+		ImagePorts: ParseImagePorts(GetEnv("CADDY_GEN_IMAGE_PORTS", "")),
+
+		Filter: filter,
+
+		Endpoints:    ParseEndpoints(GetEnv("CADDY_GEN_ENDPOINTS", "")),
+		HostAddress:  GetEnv("CADDY_GEN_HOST_ADDRESS", ""),
+		IPPreference: ParseIPPreference(GetEnv("CADDY_GEN_IP_PREFERENCE", IPv4)),
+
+		SecretsDir: GetEnv("CADDY_GEN_SECRETS_DIR", ""),
+
+		Policy: policy,
+
+		Ownership: ownership,
+
+		AuthProviders: ParseAuthProviders(GetEnv("CADDY_GEN_AUTH", "")),
+		Snippets:      ParseSnippets(GetEnv("CADDY_GEN_SNIPPETS", "")),
+
+		Maintenance: ParseMaintenanceConfig(GetEnv("CADDY_GEN_MAINTENANCE", "")),
+		Waker:       ParseWakerConfig(GetEnv("CADDY_GEN_WAKER", "")),
+	}, nil
 }
 
 // GetEnv gets an environment variable or returns a default value
@@ -37,21 +239,275 @@ func GetEnv(key, fallback string) string {
 	return fallback
 }
 
-// ParseNotifyConfig parses the notification configuration from a JSON string
-func ParseNotifyConfig(raw string) *NotifyConfig {
-	var config NotifyConfig
+// GetEnvInt gets a non-negative integer environment variable or returns a default value
+func GetEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		log.Printf("Invalid non-negative integer for %s: %q", key, value)
+		return fallback
+	}
+	return result
+}
+
+// GetEnvBool gets a boolean environment variable or returns a default value
+func GetEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %q", key, value)
+		return fallback
+	}
+	return result
+}
+
+// ParseIPPreference validates the address family of upstreams and falls back to IPv4
+func ParseIPPreference(raw string) string {
+	preference := strings.ToLower(strings.TrimSpace(raw))
+	switch preference {
+	case IPv4, IPv6, Dual:
+		return preference
+	case "":
+		return IPv4
+	}
+	log.Printf("Unknown CADDY_GEN_IP_PREFERENCE %q, falling back to %q", raw, IPv4)
+	return IPv4
+}
+
+// ParseMode validates the output mode and falls back to ModeHandle
+func ParseMode(raw string) string {
+	mode := strings.ToLower(strings.TrimSpace(raw))
+	switch mode {
+	case ModeHandle, ModeSite:
+		return mode
+	case "":
+		return ModeHandle
+	}
+	log.Printf("Unknown CADDY_GEN_MODE %q, falling back to %q", raw, ModeHandle)
+	return ModeHandle
+}
+
+// ParseNotifyConfig parses the notifiers from a JSON list or a single JSON object,
+// defaulting to a local command if empty
+func ParseNotifyConfig(raw string) []NotifyConfig {
+	if raw == "" {
+		return []NotifyConfig{{Type: NotifyCommand}}
+	}
+	var notifiers []NotifyConfig
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(raw), "[") {
+		err = json.Unmarshal([]byte(raw), &notifiers)
+	} else {
+		notifiers = make([]NotifyConfig, 1)
+		err = json.Unmarshal([]byte(raw), &notifiers[0])
+	}
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_NOTIFY: %v", err)
+		return nil
+	}
+	var result []NotifyConfig
+	for i, notifier := range notifiers {
+		if err := checkNotifier(&notifier); err != nil {
+			log.Printf("Ignoring notifier %d of CADDY_GEN_NOTIFY: %v", i+1, err)
+			continue
+		}
+		result = append(result, notifier)
+	}
+	return result
+}
+
+// checkNotifier infers the type of a notifier and checks its required fields
+func checkNotifier(notifier *NotifyConfig) error {
+	if notifier.Type == "" {
+		switch {
+		case notifier.URL != "":
+			notifier.Type = NotifyHTTP
+		case notifier.ContainerID != "" && notifier.Signal != "":
+			notifier.Type = NotifySignal
+		case notifier.ContainerID != "":
+			notifier.Type = NotifyExec
+		default:
+			notifier.Type = NotifyCommand
+		}
+	}
+	switch notifier.Type {
+	case NotifyExec:
+		if notifier.ContainerID == "" {
+			return fmt.Errorf("missing containerId for exec")
+		}
+	case NotifySignal:
+		if notifier.ContainerID == "" || notifier.Signal == "" {
+			return fmt.Errorf("missing containerId or signal for signal")
+		}
+	case NotifyHTTP:
+		if notifier.URL == "" {
+			return fmt.Errorf("missing url for http")
+		}
+	case NotifyCommand:
+	default:
+		return fmt.Errorf("unknown type %q", notifier.Type)
+	}
+	return nil
+}
+
+// ParseTLSIssuers parses the named TLS issuers from a JSON object keyed by name
+func ParseTLSIssuers(raw string) map[string]TLSIssuer {
+	issuers := make(map[string]TLSIssuer)
+	if raw == "" {
+		return issuers
+	}
+	err := json.Unmarshal([]byte(raw), &issuers)
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_TLS_ISSUERS: %v", err)
+		return make(map[string]TLSIssuer)
+	}
+	return issuers
+}
 
+// ParseFilterConfig parses the container selection rules from a JSON string
+func ParseFilterConfig(raw string) (*FilterConfig, error) {
+	var config FilterConfig
 	if raw != "" {
 		err := json.Unmarshal([]byte(raw), &config)
 		if err != nil {
-			log.Printf("Failed to parse CADDY_GEN_NOTIFY: %v", err)
+			return nil, fmt.Errorf("failed to parse CADDY_GEN_FILTER: %v", err)
+		}
+	}
+	return &config, nil
+}
+
+// ParseEndpoints parses the list of Docker endpoints from a JSON array
+func ParseEndpoints(raw string) []EndpointConfig {
+	var endpoints []EndpointConfig
+	if raw != "" {
+		err := json.Unmarshal([]byte(raw), &endpoints)
+		if err != nil {
+			log.Printf("Failed to parse CADDY_GEN_ENDPOINTS: %v", err)
 			return nil
 		}
 	}
+	return endpoints
+}
 
-	if len(config.Command) == 0 {
-		config.Command = []string{"caddy", "reload"}
+// ParsePolicyConfig parses the directive policy from a JSON string
+func ParsePolicyConfig(raw string) (*PolicyConfig, error) {
+	var config PolicyConfig
+	if raw != "" {
+		err := json.Unmarshal([]byte(raw), &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CADDY_GEN_POLICY: %v", err)
+		}
 	}
+	return &config, nil
+}
+
+// ParseOwnership parses the hostname ownership rules from a JSON array
+func ParseOwnership(raw string) ([]OwnershipRule, error) {
+	var rules []OwnershipRule
+	if raw != "" {
+		err := json.Unmarshal([]byte(raw), &rules)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CADDY_GEN_OWNERSHIP: %v", err)
+		}
+	}
+	return rules, nil
+}
+
+// ParseAuthProviders parses the named authentication providers from a JSON object keyed by name
+func ParseAuthProviders(raw string) map[string]AuthProvider {
+	providers := make(map[string]AuthProvider)
+	if raw == "" {
+		return providers
+	}
+	err := json.Unmarshal([]byte(raw), &providers)
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_AUTH: %v", err)
+		return make(map[string]AuthProvider)
+	}
+	return providers
+}
+
+// ParseSnippets parses the named snippets from a JSON object mapping names to lists of directives
+func ParseSnippets(raw string) map[string][]string {
+	snippets := make(map[string][]string)
+	if raw == "" {
+		return snippets
+	}
+	err := json.Unmarshal([]byte(raw), &snippets)
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_SNIPPETS: %v", err)
+		return make(map[string][]string)
+	}
+	return snippets
+}
 
-	return &config
+// ParseMaintenanceConfig parses the maintenance responses from a JSON object
+func ParseMaintenanceConfig(raw string) *MaintenanceConfig {
+	if raw == "" {
+		return nil
+	}
+	var maintenance MaintenanceConfig
+	err := json.Unmarshal([]byte(raw), &maintenance)
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_MAINTENANCE: %v", err)
+		return nil
+	}
+	if maintenance.Status == 0 {
+		maintenance.Status = 503
+	}
+	if maintenance.Status < 100 || maintenance.Status > 599 {
+		log.Printf("Invalid status in CADDY_GEN_MAINTENANCE: %d", maintenance.Status)
+		return nil
+	}
+	return &maintenance
+}
+
+// ParseWakerConfig parses the waker endpoint from a JSON object
+func ParseWakerConfig(raw string) *WakerConfig {
+	if raw == "" {
+		return nil
+	}
+	var waker WakerConfig
+	err := json.Unmarshal([]byte(raw), &waker)
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_WAKER: %v", err)
+		return nil
+	}
+	if waker.Upstream == "" {
+		log.Printf("Missing upstream in CADDY_GEN_WAKER")
+		return nil
+	}
+	if waker.Listen == "" {
+		waker.Listen = ":8090"
+	}
+	if waker.Timeout <= 0 {
+		waker.Timeout = 60
+	}
+	if waker.Token == "" {
+		// Only the generated configuration knows the token, it changes when caddy-gen restarts
+		token := make([]byte, 32)
+		rand.Read(token)
+		waker.Token = hex.EncodeToString(token)
+	}
+	return &waker
+}
+
+// ParseImagePorts parses the default ports per image from a JSON object
+func ParseImagePorts(raw string) map[string]int {
+	ports := make(map[string]int)
+	if raw == "" {
+		return ports
+	}
+	err := json.Unmarshal([]byte(raw), &ports)
+	if err != nil {
+		log.Printf("Failed to parse CADDY_GEN_IMAGE_PORTS: %v", err)
+		return make(map[string]int)
+	}
+	return ports
 }
@@ -24,12 +24,16 @@ func TestGetEnv(t *testing.T) {
 }
 
 func TestParseNotifyConfig(t *testing.T) {
-	// Test with valid JSON
+	// Test with a single notifier
 	validJSON := `{"containerId":"test-container","workingDir":"/app","command":["caddy","reload"]}`
-	config := ParseNotifyConfig(validJSON)
+	notifiers := ParseNotifyConfig(validJSON)
 
-	if config == nil {
-		t.Fatal("ParseNotifyConfig() returned nil for valid JSON")
+	if len(notifiers) != 1 {
+		t.Fatalf("ParseNotifyConfig() = %+v; want 1 notifier", notifiers)
+	}
+	config := notifiers[0]
+	if config.Type != NotifyExec {
+		t.Errorf("config.Type = %s; want exec", config.Type)
 	}
 	if config.ContainerID != "test-container" {
 		t.Errorf("config.ContainerID = %s; want test-container", config.ContainerID)
@@ -41,16 +45,32 @@ func TestParseNotifyConfig(t *testing.T) {
 		t.Errorf("config.Command = %v; want [caddy reload]", config.Command)
 	}
 
+	// Test with a chain, types are inferred and invalid notifiers are dropped
+	notifiers = ParseNotifyConfig(`[
+		{"containerId":"caddy","signal":"SIGUSR1"},
+		{"url":"http://monitor/hook","retries":2},
+		{"type":"http"},
+		{"type":"mail"},
+		{"command":["true"]}
+	]`)
+	var types []string
+	for _, notifier := range notifiers {
+		types = append(types, notifier.Type)
+	}
+	if strings.Join(types, " ") != "signal http command" || notifiers[1].Retries != 2 {
+		t.Errorf("ParseNotifyConfig() = %+v; want signal, http and command notifiers", notifiers)
+	}
+
 	// Test with empty string
-	config = ParseNotifyConfig("")
-	if config == nil || strings.Join(config.Command, " ") != "caddy reload" {
-		t.Errorf("ParseNotifyConfig() = %v; want default config", config)
+	notifiers = ParseNotifyConfig("")
+	if len(notifiers) != 1 || notifiers[0].Type != NotifyCommand || notifiers[0].Command != nil {
+		t.Errorf("ParseNotifyConfig() = %+v; want a local command with the default left to the notifier", notifiers)
 	}
 
 	// Test with invalid JSON
-	config = ParseNotifyConfig("{invalid json}")
-	if config != nil {
-		t.Errorf("ParseNotifyConfig() = %v; want nil", config)
+	notifiers = ParseNotifyConfig("{invalid json}")
+	if notifiers != nil {
+		t.Errorf("ParseNotifyConfig() = %v; want nil", notifiers)
 	}
 }
 
@@ -65,7 +85,10 @@ func TestNewConfig(t *testing.T) {
 		os.Unsetenv("CADDY_GEN_NOTIFY")
 	}()
 
-	config := NewConfig()
+	config, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig() error: %s", err)
+	}
 
 	if config.Network != "test-network" {
 		t.Errorf("config.Network = %s; want test-network", config.Network)
@@ -73,10 +96,153 @@ func TestNewConfig(t *testing.T) {
 	if config.OutFile != "test-outfile" {
 		t.Errorf("config.OutFile = %s; want test-outfile", config.OutFile)
 	}
-	if config.Notify == nil {
-		t.Fatal("config.Notify is nil")
+	if len(config.Notify) != 1 {
+		t.Fatalf("config.Notify = %+v; want 1 notifier", config.Notify)
+	}
+	if config.Notify[0].ContainerID != "test-container" {
+		t.Errorf("config.Notify[0].ContainerID = %s; want test-container", config.Notify[0].ContainerID)
+	}
+
+	// An invalid filter is an error rather than an empty filter selecting every container
+	t.Setenv("CADDY_GEN_FILTER", `{"projects":"shop"}`)
+	if config, err := NewConfig(); err == nil {
+		t.Errorf("NewConfig() = %+v; want error", config)
+	}
+}
+
+func TestParsePolicyConfig(t *testing.T) {
+	policy, err := ParsePolicyConfig(`{"host":{"deny":["import"]}}`)
+	if err != nil || policy.Host == nil || policy.Host.Deny[0] != "import" {
+		t.Errorf("ParsePolicyConfig() = %+v, %v; want host deny list", policy, err)
+	}
+
+	// An invalid policy is an error rather than an empty policy allowing everything
+	if policy, err := ParsePolicyConfig(`{"host":{"deny":"import"}`); err == nil {
+		t.Errorf("ParsePolicyConfig() = %+v; want error", policy)
+	}
+	t.Setenv("CADDY_GEN_POLICY", "{invalid json}")
+	if config, err := NewConfig(); err == nil {
+		t.Errorf("NewConfig() = %+v; want error for invalid policy", config)
+	}
+}
+
+func TestParseOwnership(t *testing.T) {
+	rules, err := ParseOwnership(`[{"hosts":["*.billing.example.com"],"projects":["billing"]}]`)
+	if err != nil || len(rules) != 1 || rules[0].Projects[0] != "billing" {
+		t.Errorf("ParseOwnership() = %+v, %v; want 1 rule", rules, err)
+	}
+
+	// Invalid rules are an error rather than no rules letting anyone claim any hostname
+	if rules, err := ParseOwnership(`{"hosts":["*.billing.example.com"]}`); err == nil {
+		t.Errorf("ParseOwnership() = %+v; want error", rules)
+	}
+	t.Setenv("CADDY_GEN_OWNERSHIP", "[invalid json]")
+	if config, err := NewConfig(); err == nil {
+		t.Errorf("NewConfig() = %+v; want error for invalid ownership rules", config)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	if mode := ParseMode("site"); mode != ModeSite {
+		t.Errorf("ParseMode(site) = %s; want %s", mode, ModeSite)
+	}
+	if mode := ParseMode(" Handle "); mode != ModeHandle {
+		t.Errorf("ParseMode(Handle) = %s; want %s", mode, ModeHandle)
+	}
+	if mode := ParseMode("unknown"); mode != ModeHandle {
+		t.Errorf("ParseMode(unknown) = %s; want %s", mode, ModeHandle)
+	}
+}
+
+func TestParseTLSIssuers(t *testing.T) {
+	issuers := ParseTLSIssuers(`{"cloudflare":{"email":"admin@example.com","dns":"cloudflare {env.CF_API_TOKEN}"}}`)
+	if issuers["cloudflare"].DNS != "cloudflare {env.CF_API_TOKEN}" {
+		t.Errorf("issuers = %v; want cloudflare issuer", issuers)
+	}
+
+	issuers = ParseTLSIssuers("{invalid json}")
+	if len(issuers) != 0 {
+		t.Errorf("ParseTLSIssuers() = %v; want empty map", issuers)
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	t.Setenv("TEST_ENV_INT", "10")
+	if result := GetEnvInt("TEST_ENV_INT", 5); result != 10 {
+		t.Errorf("GetEnvInt() = %d; want 10", result)
+	}
+
+	for _, value := range []string{"invalid", "-1"} {
+		t.Setenv("TEST_ENV_INT", value)
+		if result := GetEnvInt("TEST_ENV_INT", 5); result != 5 {
+			t.Errorf("GetEnvInt(%q) = %d; want default 5", value, result)
+		}
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	os.Setenv("TEST_ENV_BOOL", "true")
+	defer os.Unsetenv("TEST_ENV_BOOL")
+	if !GetEnvBool("TEST_ENV_BOOL", false) {
+		t.Errorf("GetEnvBool() = false; want true")
+	}
+
+	os.Setenv("TEST_ENV_BOOL", "invalid")
+	if !GetEnvBool("TEST_ENV_BOOL", true) {
+		t.Errorf("GetEnvBool() = false; want default true")
+	}
+
+	if GetEnvBool("NON_EXISTING_VAR", false) {
+		t.Errorf("GetEnvBool() = true; want default false")
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	endpoints := ParseEndpoints(`[{"name":"local"},{"name":"edge","host":"tcp://10.0.0.2:2376","address":"10.0.0.2"},{"context":"prod"}]`)
+	if len(endpoints) != 3 {
+		t.Fatalf("ParseEndpoints() returned %d endpoints; want 3", len(endpoints))
+	}
+	if endpoints[1].Host != "tcp://10.0.0.2:2376" || endpoints[1].Address != "10.0.0.2" {
+		t.Errorf("endpoints[1] = %+v; want host and address", endpoints[1])
+	}
+	if endpoints[2].Context != "prod" {
+		t.Errorf("endpoints[2].Context = %s; want prod", endpoints[2].Context)
+	}
+
+	if endpoints := ParseEndpoints(""); len(endpoints) != 0 {
+		t.Errorf("ParseEndpoints() = %v; want no endpoint", endpoints)
+	}
+}
+
+func TestParseMaintenanceConfig(t *testing.T) {
+	if maintenance := ParseMaintenanceConfig(`{"body":"Down for maintenance"}`); maintenance == nil || maintenance.Status != 503 {
+		t.Errorf("ParseMaintenanceConfig() = %+v; want default status 503", maintenance)
+	}
+	for _, raw := range []string{"", `{"status":700}`, `{"status":"503"}`} {
+		if maintenance := ParseMaintenanceConfig(raw); maintenance != nil {
+			t.Errorf("ParseMaintenanceConfig(%q) = %+v; want nil", raw, maintenance)
+		}
+	}
+}
+
+func TestParseWakerConfig(t *testing.T) {
+	waker := ParseWakerConfig(`{"upstream":"caddy-gen:8090"}`)
+	if waker == nil || waker.Listen != ":8090" || waker.Timeout != 60 {
+		t.Errorf("ParseWakerConfig() = %+v; want defaults for listen and timeout", waker)
+	}
+	if other := ParseWakerConfig(`{"upstream":"caddy-gen:8090"}`); len(waker.Token) != 64 || other.Token == waker.Token {
+		t.Errorf("ParseWakerConfig().Token = %s, %s; want distinct random tokens", waker.Token, other.Token)
+	}
+	if waker := ParseWakerConfig(`{"listen":":9000"}`); waker != nil {
+		t.Errorf("ParseWakerConfig() = %+v; want nil without upstream", waker)
+	}
+}
+
+func TestParseIPPreference(t *testing.T) {
+	if preference := ParseIPPreference(" Dual "); preference != Dual {
+		t.Errorf("ParseIPPreference(Dual) = %s; want %s", preference, Dual)
 	}
-	if config.Notify.ContainerID != "test-container" {
-		t.Errorf("config.Notify.ContainerID = %s; want test-container", config.Notify.ContainerID)
+	if preference := ParseIPPreference("ipv5"); preference != IPv4 {
+		t.Errorf("ParseIPPreference(ipv5) = %s; want %s", preference, IPv4)
 	}
 }
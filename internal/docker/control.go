@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+var _ source.Controller = (*Client)(nil)
+
+// healthInterval is the delay between checks of a starting container
+const healthInterval = 500 * time.Millisecond
+
+// findEndpoint returns the endpoint a record originates from
+func (c *Client) findEndpoint(record source.Record) (*endpoint, error) {
+	for _, ep := range c.endpoints {
+		if ep.name == record.Origin {
+			return ep, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown endpoint: %s", record.Origin)
+}
+
+// Start starts a container and waits until it is running and, if it has a health check, healthy
+func (c *Client) Start(ctx context.Context, record source.Record) error {
+	ep, err := c.findEndpoint(record)
+	if err != nil {
+		return err
+	}
+	if err := ep.client.ContainerStart(ctx, record.Name, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start %s: %v", record.Name, err)
+	}
+	for {
+		info, err := ep.client.ContainerInspect(ctx, record.Name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %v", record.Name, err)
+		}
+		state := info.State
+		if state.Running && (state.Health == nil || state.Health.Status == container.Healthy) {
+			return nil
+		}
+		if state.Status == "exited" || state.Status == "dead" {
+			return fmt.Errorf("container %s is %s", record.Name, state.Status)
+		}
+		if state.Health != nil && state.Health.Status == container.Unhealthy {
+			return fmt.Errorf("container %s is unhealthy", record.Name)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("container %s is not ready: %v", record.Name, ctx.Err())
+		case <-time.After(healthInterval):
+		}
+	}
+}
+
+// Stop stops a container
+func (c *Client) Stop(ctx context.Context, record source.Record) error {
+	ep, err := c.findEndpoint(record)
+	if err != nil {
+		return err
+	}
+	return ep.client.ContainerStop(ctx, record.Name, container.StopOptions{})
+}
+
+// Traffic returns the bytes received by a container on all its networks
+func (c *Client) Traffic(ctx context.Context, record source.Record) (uint64, error) {
+	ep, err := c.findEndpoint(record)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ep.client.ContainerStatsOneShot(ctx, record.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var stats container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, network := range stats.Networks {
+		total += network.RxBytes
+	}
+	return total, nil
+}
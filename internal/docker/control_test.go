@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/docker/dockertest"
+)
+
+func TestStartStop(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	tool := newTestContainer("tool", "tool", map[string]string{"virtual.wake": "true"})
+	tool.State = "exited"
+	srv.SetContainers(tool)
+	srv.SetHealth("tool", "starting")
+	srv.SetTraffic("tool", 1234)
+	client := newTestClient(t, &config.Config{Network: "gateway", Waker: &config.WakerConfig{}}, srv)
+	records, err := client.Records()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Records() = %+v, %v; want [tool]", records, err)
+	}
+	record := records[0]
+
+	// Start waits for the health check to pass
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		srv.SetHealth("tool", "healthy")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	started := time.Now()
+	if err := client.Start(ctx, record); err != nil {
+		t.Fatalf("Start() error: %s", err)
+	}
+	if srv.State("tool") != "running" || time.Since(started) < 100*time.Millisecond {
+		t.Errorf("Start() returned with state %s; want running and healthy", srv.State("tool"))
+	}
+
+	if rxBytes, err := client.Traffic(ctx, record); err != nil || rxBytes != 1234 {
+		t.Errorf("Traffic() = %d, %v; want 1234", rxBytes, err)
+	}
+
+	if err := client.Stop(ctx, record); err != nil || srv.State("tool") != "exited" {
+		t.Errorf("Stop() = %v with state %s; want exited", err, srv.State("tool"))
+	}
+
+	record.Origin = "unknown"
+	if err := client.Start(ctx, record); err == nil {
+		t.Errorf("Start() of unknown endpoint = nil error; want error")
+	}
+}
@@ -4,7 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os/exec"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
@@ -12,93 +13,214 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/source"
 )
 
-// Client wraps the Docker client with additional functionality
+// Client wraps the Docker clients of all endpoints with additional functionality
 type Client struct {
-	client *client.Client
-	config *config.Config
+	endpoints []*endpoint
+	config    *config.Config
+	selector  *selector
+}
+
+var _ source.Source = (*Client)(nil)
+
+// Container is a container listed from one of the endpoints
+type Container struct {
+	container.Summary
+	Endpoint string   // Name of the endpoint running the container
+	Address  string   // Address of the host to reach published ports, empty if reachable on Network
+	Network  string   // Docker network the container is reached on
+	Env      []string // Environment variables, only fetched if referenced by labels
 }
 
 // NewClient creates a new Docker client
 func NewClient(cfg *config.Config) (*Client, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	endpointConfigs := cfg.Endpoints
+	if len(endpointConfigs) == 0 {
+		endpointConfigs = []config.EndpointConfig{{}}
+	}
+	var endpoints []*endpoint
+	for _, endpointConfig := range endpointConfigs {
+		ep, err := newEndpoint(endpointConfig, cfg.Network)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Docker client: %v", err)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	sel, err := newSelector(cfg.Filter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Docker client: %v", err)
+		return nil, fmt.Errorf("failed to create container filter: %v", err)
 	}
 	return &Client{
-		client: cli,
-		config: cfg,
+		endpoints: endpoints,
+		config:    cfg,
+		selector:  sel,
 	}, nil
 }
 
-// Close closes the Docker client
+// Close closes the Docker clients
 func (c *Client) Close() error {
-	return c.client.Close()
+	var firstErr error
+	for _, ep := range c.endpoints {
+		if err := ep.client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func (c *Client) ListContainers() ([]container.Summary, error) {
+// primary returns the Docker client of the first endpoint
+func (c *Client) primary() *client.Client {
+	return c.endpoints[0].client
+}
+
+// ListContainers lists the managed containers of all endpoints,
+// an endpoint that is down keeps its containers from the last successful listing
+func (c *Client) ListContainers() ([]Container, error) {
+	var result []Container
+	failed := 0
+	for _, ep := range c.endpoints {
+		containers, err := c.listEndpointContainers(ep)
+		if err != nil {
+			failed += 1
+			log.Printf("Failed to list containers of endpoint %s: %v", ep.name, err)
+		}
+		result = append(result, containers...)
+	}
+	if failed == len(c.endpoints) && len(result) == 0 {
+		return nil, fmt.Errorf("all Docker endpoints are unavailable")
+	}
+	return result, nil
+}
+
+func (c *Client) listEndpointContainers(ep *endpoint) ([]Container, error) {
 	ctx := context.Background()
 	args := c.createListFilter()
-	return c.client.ContainerList(ctx, container.ListOptions{
+	containers, err := ep.client.ContainerList(ctx, container.ListOptions{
 		Filters: args,
 	})
+	if err != nil {
+		ep.mu.Lock()
+		defer ep.mu.Unlock()
+		return ep.containers, err
+	}
+	var result []Container
+	for _, ct := range containers {
+		if len(ct.Names) == 0 || !c.selector.Match(ct.Names[0], ct.Labels) {
+			continue
+		}
+		address := ep.address
+		if address == "" && !isOnNetwork(ct, ep.network) {
+			// Containers outside the network must opt in and are reached through the host
+			if !hasBindLabel(ct.Labels) {
+				continue
+			}
+			address = ep.hostAddress(ctx, c.config.HostAddress)
+		}
+		result = append(result, Container{
+			Summary:  ct,
+			Endpoint: ep.name,
+			Address:  address,
+			Network:  ep.network,
+			Env:      c.inspectEnv(ctx, ep, ct),
+		})
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.containers = result
+	return result, nil
+}
+
+// inspectEnv fetches the environment of containers whose labels reference it
+func (c *Client) inspectEnv(ctx context.Context, ep *endpoint, ct container.Summary) []string {
+	if !strings.Contains(ct.Labels["virtual.bind"], "${") {
+		return nil
+	}
+	info, err := ep.client.ContainerInspect(ctx, ct.ID)
+	if err != nil {
+		log.Printf("Failed to inspect container %s: %v", ct.ID, err)
+		return nil
+	}
+	if info.Config == nil {
+		return nil
+	}
+	return info.Config.Env
 }
 
 func (c *Client) createListFilter() filters.Args {
 	args := filters.NewArgs()
-	args.Add("network", c.config.Network)
+	// Containers on any network are listed, those outside the network are reached through the host
 	args.Add("status", "created")
 	args.Add("status", "running")
+	if c.config.Maintenance != nil || c.config.Waker != nil {
+		// Stopped containers keep their routes to serve the maintenance response or be woken up
+		args.Add("status", "restarting")
+		args.Add("status", "paused")
+		args.Add("status", "exited")
+	}
+	c.addLabelFilters(args)
 	return args
 }
 
-// Notify notifies the Caddy container to reload
-func (c *Client) Notify() {
-	if c.config.Notify == nil {
-		return
-	}
-	if c.config.Notify.ContainerID == "" {
-		name := c.config.Notify.Command[0]
-		args := c.config.Notify.Command[1:]
-		cmd := exec.Command(name, args...)
-		cmd.Run()
-		return
+// addLabelFilters lets the daemon apply the required labels of the selector
+func (c *Client) addLabelFilters(args filters.Args) {
+	for _, label := range c.selector.filter.Labels {
+		args.Add("label", label)
 	}
-	log.Printf("Notify: %+v", c.config.Notify)
-	ctx := context.Background()
-	c.executeCommand(ctx, c.config.Notify)
 }
 
-func (c *Client) executeCommand(ctx context.Context, notifyConfig *config.NotifyConfig) {
-	execConfig := c.createExecConfig(notifyConfig)
-	resp, err := c.client.ContainerExecCreate(ctx, notifyConfig.ContainerID, execConfig)
+// execInterval is the delay between checks of a running exec instance
+const execInterval = 100 * time.Millisecond
+
+// Exec runs a command in a container of the primary endpoint and returns its exit code once it finished
+func (c *Client) Exec(ctx context.Context, containerID string, options container.ExecOptions) (int, error) {
+	resp, err := c.primary().ContainerExecCreate(ctx, containerID, options)
 	if err != nil {
-		log.Printf("Failed to create exec: %v", err)
-		return
+		return 0, fmt.Errorf("failed to create exec: %v", err)
 	}
-	err = c.client.ContainerExecStart(ctx, resp.ID, container.ExecStartOptions{})
+	err = c.primary().ContainerExecStart(ctx, resp.ID, container.ExecStartOptions{Detach: true})
 	if err != nil {
-		log.Printf("Failed to start exec: %v", err)
+		return 0, fmt.Errorf("failed to start exec: %v", err)
+	}
+	for {
+		info, err := c.primary().ContainerExecInspect(ctx, resp.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to inspect exec: %v", err)
+		}
+		if !info.Running {
+			return info.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("exec did not finish: %v", ctx.Err())
+		case <-time.After(execInterval):
+		}
 	}
 }
 
-func (c *Client) createExecConfig(notifyConfig *config.NotifyConfig) container.ExecOptions {
-	return container.ExecOptions{
-		Cmd:          notifyConfig.Command,
-		WorkingDir:   notifyConfig.WorkingDir,
-		AttachStdout: false,
-		AttachStderr: false,
-		Detach:       true,
+// Signal sends a signal to a container of the primary endpoint
+func (c *Client) Signal(ctx context.Context, containerID, signal string) error {
+	if err := c.primary().ContainerKill(ctx, containerID, signal); err != nil {
+		return fmt.Errorf("failed to signal %s: %v", containerID, err)
 	}
+	return nil
 }
 
-// WatchEvents watches for Docker events and calls the callback function
+// WatchEvents watches for Docker events of all endpoints and calls the callback function
 func (c *Client) WatchEvents(callback func()) {
 	ctx := context.Background()
 	args := c.createEventFilter()
 	debouncedCallback := debounce(callback, 1*time.Second)
-	c.watchEventLoop(ctx, args, debouncedCallback)
+	var wg sync.WaitGroup
+	for _, ep := range c.endpoints {
+		wg.Add(1)
+		go func(ep *endpoint) {
+			defer wg.Done()
+			c.watchEventLoop(ctx, ep, args, debouncedCallback)
+		}(ep)
+	}
+	wg.Wait()
 }
 
 // createEventFilter creates a filter for container events
@@ -107,13 +229,33 @@ func (c *Client) createEventFilter() filters.Args {
 	args.Add("type", "container")
 	args.Add("event", "start")
 	args.Add("event", "stop")
+	args.Add("event", "die")
+	args.Add("event", "pause")
+	args.Add("event", "unpause")
+	args.Add("event", "destroy")
+	c.addLabelFilters(args)
 	return args
 }
 
-// watchEventLoop watches for Docker events in a loop
-func (c *Client) watchEventLoop(ctx context.Context, args filters.Args, callback func()) {
+// watchEventLoop watches for Docker events of an endpoint in a loop
+func (c *Client) watchEventLoop(ctx context.Context, ep *endpoint, args filters.Args, callback func()) {
+	connected := true
 	for {
-		messages, errs := c.client.Events(ctx, events.ListOptions{
+		if _, err := ep.client.Ping(ctx); err != nil {
+			if connected {
+				log.Printf("Endpoint %s is unavailable: %v", ep.name, err)
+				connected = false
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if !connected {
+			// Events may have been missed while the endpoint was down
+			log.Printf("Endpoint %s is available again", ep.name)
+			connected = true
+			callback()
+		}
+		messages, errs := ep.client.Events(ctx, events.ListOptions{
 			Filters: args,
 		})
 		c.processEvents(messages, errs, callback)
@@ -124,8 +266,11 @@ func (c *Client) watchEventLoop(ctx context.Context, args filters.Args, callback
 func (c *Client) processEvents(messages <-chan events.Message, errs <-chan error, callback func()) {
 	for {
 		select {
-		case <-messages:
-			callback()
+		case msg := <-messages:
+			// Event attributes hold the container name and labels
+			if c.selector.Match(msg.Actor.Attributes["name"], msg.Actor.Attributes) {
+				callback()
+			}
 		case err := <-errs:
 			if err != nil {
 				log.Printf("Error receiving events: %v", err)
@@ -138,11 +283,81 @@ func (c *Client) processEvents(messages <-chan events.Message, errs <-chan error
 
 // Debounce function to avoid multiple callbacks
 func debounce(f func(), delay time.Duration) func() {
+	var mu sync.Mutex
 	var timer *time.Timer
 	return func() {
+		mu.Lock()
+		defer mu.Unlock()
 		if timer != nil {
 			timer.Stop()
 		}
 		timer = time.AfterFunc(delay, f)
 	}
 }
+
+// Records returns the route records of the managed containers
+func (c *Client) Records() ([]source.Record, error) {
+	containers, err := c.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var records []source.Record
+	for _, ct := range containers {
+		records = append(records, ct.Record())
+	}
+	return records, nil
+}
+
+// bindLabels are the labels of containers routed even outside the network
+var bindLabels = []string{"virtual.bind", "virtual.l4"}
+
+func hasBindLabel(labels map[string]string) bool {
+	for _, label := range bindLabels {
+		if _, exists := labels[label]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+func isOnNetwork(ct container.Summary, network string) bool {
+	if ct.NetworkSettings == nil {
+		return false
+	}
+	_, exists := ct.NetworkSettings.Networks[network]
+	return exists
+}
+
+// Record normalizes a container into a route record
+func (ct Container) Record() source.Record {
+	record := source.Record{
+		Name:        strings.TrimPrefix(ct.Names[0], "/"),
+		Labels:      ct.Labels,
+		Image:       ct.Image,
+		Origin:      ct.Endpoint,
+		HostAddress: ct.Address,
+		HostNetwork: ct.HostConfig.NetworkMode == "host",
+		State:       ct.State,
+	}
+	if ct.NetworkSettings != nil {
+		if networkSettings, exists := ct.NetworkSettings.Networks[ct.Network]; exists {
+			record.IP = networkSettings.IPAddress
+			record.IPv6 = networkSettings.GlobalIPv6Address
+		}
+	}
+	if ct.Env != nil {
+		record.Env = make(map[string]string)
+		for _, item := range ct.Env {
+			key, value, _ := strings.Cut(item, "=")
+			record.Env[key] = value
+		}
+	}
+	for _, port := range ct.Ports {
+		record.Ports = append(record.Ports, source.Port{
+			Private:  int(port.PrivatePort),
+			Public:   int(port.PublicPort),
+			Protocol: port.Type,
+		})
+	}
+	return record
+}
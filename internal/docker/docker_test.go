@@ -0,0 +1,258 @@
+package docker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/docker/dockertest"
+)
+
+func newTestContainer(id, name string, labels map[string]string) container.Summary {
+	return container.Summary{
+		ID:     id,
+		Names:  []string{"/" + name},
+		Labels: labels,
+		State:  "running",
+		NetworkSettings: &container.NetworkSettingsSummary{
+			Networks: map[string]*network.EndpointSettings{
+				"gateway": {IPAddress: "172.17.0.2"},
+			},
+		},
+	}
+}
+
+func newTestClient(t *testing.T, cfg *config.Config, servers ...*dockertest.Server) *Client {
+	for i, srv := range servers {
+		cfg.Endpoints = append(cfg.Endpoints, config.EndpointConfig{
+			Name: string(rune('a' + i)),
+			Host: srv.Host(),
+		})
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient() error: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestListContainers(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	web := newTestContainer("web", "web", map[string]string{"virtual.bind": "80 example.com"})
+	stopped := newTestContainer("stopped", "stopped", map[string]string{})
+	stopped.State = "exited"
+	other := newTestContainer("other", "other", map[string]string{})
+	other.NetworkSettings.Networks = map[string]*network.EndpointSettings{"bridge": {}}
+	srv.SetContainers(web, stopped, other)
+
+	client := newTestClient(t, &config.Config{Network: "gateway"}, srv)
+	containers, err := client.ListContainers()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(containers) != 1 || containers[0].ID != "web" || containers[0].Endpoint != "a" {
+		t.Errorf("ListContainers() = %+v; want [web] from endpoint a", containers)
+	}
+
+	records, err := client.Records()
+	if err != nil || len(records) != 1 || records[0].Name != "web" || records[0].IP != "172.17.0.2" {
+		t.Errorf("Records() = %+v, %v; want [web] with IP 172.17.0.2", records, err)
+	}
+	// Stopped containers are kept to serve maintenance responses
+	client = newTestClient(t, &config.Config{Network: "gateway", Maintenance: &config.MaintenanceConfig{Status: 503}}, srv)
+	records, err = client.Records()
+	if err != nil || len(records) != 2 || records[1].Name != "stopped" || records[1].Running() {
+		t.Errorf("Records() = %+v, %v; want [web stopped] with stopped not running", records, err)
+	}
+}
+
+func TestListContainersUnavailable(t *testing.T) {
+	srvA := dockertest.NewServer(t)
+	srvB := dockertest.NewServer(t)
+	srvA.SetContainers(newTestContainer("a1", "a1", map[string]string{}))
+	srvB.SetContainers(newTestContainer("b1", "b1", map[string]string{}))
+	client := newTestClient(t, &config.Config{Network: "gateway"}, srvA, srvB)
+
+	containers, err := client.ListContainers()
+	if err != nil || len(containers) != 2 {
+		t.Fatalf("ListContainers() = %+v, %v; want 2 containers", containers, err)
+	}
+
+	// Containers of an unavailable endpoint are kept from the last listing
+	srvB.SetUnavailable(true)
+	srvA.SetContainers()
+	containers, err = client.ListContainers()
+	if err != nil || len(containers) != 1 || containers[0].ID != "b1" {
+		t.Errorf("ListContainers() = %+v, %v; want [b1]", containers, err)
+	}
+
+	srvA.SetUnavailable(true)
+	srvB.Close()
+	client = newTestClient(t, &config.Config{Network: "gateway"}, srvA)
+	if _, err := client.ListContainers(); err == nil {
+		t.Errorf("ListContainers() with all endpoints down returned no error")
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	web := newTestContainer("web", "web", map[string]string{"team": "web"})
+	ignored := newTestContainer("ignored", "ignored", map[string]string{"team": "billing"})
+	srv.SetContainers(web, ignored)
+	client := newTestClient(t, &config.Config{
+		Network: "gateway",
+		Filter:  &config.FilterConfig{ExcludeLabels: []string{"team=billing"}},
+	}, srv)
+
+	called := make(chan struct{}, 10)
+	go client.WatchEvents(func() { called <- struct{}{} })
+	waitFor(t, func() bool { return srv.Subscribers() == 1 })
+
+	// Events of unselected containers are ignored
+	srv.EmitContainer("start", ignored)
+	select {
+	case <-called:
+		t.Fatal("WatchEvents() called back for an unselected container")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// Events are debounced
+	srv.EmitContainer("start", web)
+	srv.EmitContainer("stop", web)
+	select {
+	case <-called:
+	case <-time.After(3 * time.Second):
+		t.Fatal("WatchEvents() did not call back")
+	}
+	select {
+	case <-called:
+		t.Fatal("WatchEvents() did not debounce events")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestExec(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	srv.SetContainers(newTestContainer("caddy-id", "caddy", map[string]string{}))
+	client := newTestClient(t, &config.Config{Network: "gateway"}, srv)
+	ctx := context.Background()
+
+	code, err := client.Exec(ctx, "caddy", container.ExecOptions{
+		Cmd:        []string{"caddy", "reload"},
+		WorkingDir: "/etc/caddy",
+		User:       "caddy",
+	})
+	if err != nil || code != 0 {
+		t.Fatalf("Exec() = %d, %v; want exit code 0", code, err)
+	}
+	execs := srv.Execs()
+	if len(execs) != 1 {
+		t.Fatalf("Execs() = %+v; want 1 exec", execs)
+	}
+	if execs[0].ContainerID != "caddy-id" || !execs[0].Started {
+		t.Errorf("execs[0] = %+v; want started exec in caddy-id", execs[0])
+	}
+	if execs[0].Options.WorkingDir != "/etc/caddy" || execs[0].Options.User != "caddy" || len(execs[0].Options.Cmd) != 2 {
+		t.Errorf("execs[0].Options = %+v; want caddy reload in /etc/caddy as caddy", execs[0].Options)
+	}
+
+	// Test exit code of the finished exec
+	srv.SetExitCode(1)
+	if code, err := client.Exec(ctx, "caddy", container.ExecOptions{Cmd: []string{"false"}}); err != nil || code != 1 {
+		t.Errorf("Exec() = %d, %v; want exit code 1", code, err)
+	}
+
+	// Test missing container
+	if _, err := client.Exec(ctx, "missing", container.ExecOptions{Cmd: []string{"true"}}); err == nil {
+		t.Errorf("Exec() in missing container returned no error")
+	}
+	if execs := srv.Execs(); len(execs) != 2 {
+		t.Errorf("Execs() = %+v; want no exec for missing container", execs)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	srv.SetContainers(newTestContainer("caddy-id", "caddy", map[string]string{}))
+	client := newTestClient(t, &config.Config{Network: "gateway"}, srv)
+
+	if err := client.Signal(context.Background(), "caddy", "SIGUSR1"); err != nil {
+		t.Fatalf("Signal() error: %s", err)
+	}
+	if signals := srv.Signals("caddy-id"); len(signals) != 1 || signals[0] != "SIGUSR1" {
+		t.Errorf("Signals() = %v; want [SIGUSR1]", signals)
+	}
+	if err := client.Signal(context.Background(), "missing", "SIGUSR1"); err == nil {
+		t.Errorf("Signal() to missing container returned no error")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInspectEnv(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	srv.SetContainers(
+		newTestContainer("web", "web", map[string]string{"virtual.bind": "${PORT} web.example.com"}),
+		newTestContainer("static", "static", map[string]string{"virtual.bind": "80 static.example.com"}),
+	)
+	srv.SetEnv("web", "PORT=3000", "EMPTY=")
+	srv.SetEnv("static", "PORT=8080")
+	client := newTestClient(t, &config.Config{Network: "gateway"}, srv)
+
+	records, err := client.Records()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Records() = %+v, %v; want 2 records", records, err)
+	}
+	if records[0].Env["PORT"] != "3000" {
+		t.Errorf("records[0].Env = %v; want PORT=3000", records[0].Env)
+	}
+	if records[1].Env != nil {
+		t.Errorf("records[1].Env = %v; want no env for labels without references", records[1].Env)
+	}
+}
+
+func TestContainersOutsideNetwork(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	srv.SetGateway("gateway", "172.17.0.1")
+	host := newTestContainer("host", "host", map[string]string{"virtual.bind": "8080 host.example.com"})
+	host.HostConfig.NetworkMode = "host"
+	host.NetworkSettings.Networks = map[string]*network.EndpointSettings{"host": {}}
+	bridge := newTestContainer("bridge", "bridge", map[string]string{"virtual.bind": "80 bridge.example.com"})
+	bridge.NetworkSettings.Networks = map[string]*network.EndpointSettings{"bridge": {IPAddress: "172.18.0.2"}}
+	bridge.Ports = []container.Port{{PrivatePort: 80, PublicPort: 8081, Type: "tcp"}}
+	unlabeled := newTestContainer("unlabeled", "unlabeled", map[string]string{})
+	unlabeled.NetworkSettings.Networks = map[string]*network.EndpointSettings{"bridge": {}}
+	srv.SetContainers(host, bridge, unlabeled)
+
+	client := newTestClient(t, &config.Config{Network: "gateway"}, srv)
+	records, err := client.Records()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Records() = %+v, %v; want [host bridge]", records, err)
+	}
+	if !records[0].HostNetwork || records[0].HostAddress != "172.17.0.1" || records[0].IP != "" {
+		t.Errorf("records[0] = %+v; want host network at the gateway", records[0])
+	}
+	if records[1].HostNetwork || records[1].HostAddress != "172.17.0.1" || records[1].Ports[0].Public != 8081 {
+		t.Errorf("records[1] = %+v; want published port at the gateway", records[1])
+	}
+
+	// A configured host address replaces the gateway
+	client = newTestClient(t, &config.Config{Network: "gateway", HostAddress: "host.docker.internal"}, srv)
+	records, _ = client.Records()
+	if len(records) != 2 || records[0].HostAddress != "host.docker.internal" {
+		t.Errorf("Records() = %+v; want host address host.docker.internal", records)
+	}
+}
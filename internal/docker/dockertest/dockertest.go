@@ -0,0 +1,488 @@
+// Package dockertest serves the subset of the Docker Engine API used by caddy-gen
+// from an in-process server, so the watch, generate and notify cycle can be tested
+// without a Docker daemon.
+package dockertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+)
+
+// APIVersion is the Docker API version reported by the server
+const APIVersion = "1.47"
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// Exec is an exec instance created through the server
+type Exec struct {
+	ID          string
+	ContainerID string
+	Options     container.ExecOptions
+	Started     bool
+}
+
+// Server is a fake Docker daemon whose state is scripted by the test
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	containers  []container.Summary
+	env         map[string][]string
+	health      map[string]string
+	traffic     map[string]uint64
+	gateways    map[string]string
+	execs       []*Exec
+	signals     map[string][]string
+	exitCode    int
+	unavailable bool
+	subscribers []chan events.Message
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewServer starts a fake Docker daemon that is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		env:      make(map[string][]string),
+		health:   make(map[string]string),
+		traffic:  make(map[string]uint64),
+		gateways: make(map[string]string),
+		signals:  make(map[string][]string),
+		done:     make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close ends the event streams and shuts down the server
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Server.Close()
+	})
+}
+
+// Host returns the address of the server to use as Docker host
+func (s *Server) Host() string {
+	return "tcp://" + strings.TrimPrefix(s.URL, "http://")
+}
+
+// SetContainers replaces the containers of the daemon
+func (s *Server) SetContainers(containers ...container.Summary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers = containers
+}
+
+// SetEnv sets the environment variables of a container, returned when it is inspected
+func (s *Server) SetEnv(id string, env ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.env[id] = env
+}
+
+// SetHealth sets the health status of a container, returned when it is inspected
+func (s *Server) SetHealth(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health[id] = status
+}
+
+// SetTraffic sets the bytes received by a container, returned in its stats
+func (s *Server) SetTraffic(id string, rxBytes uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traffic[id] = rxBytes
+}
+
+// State returns the state of a container, empty if it does not exist
+func (s *Server) State(ref string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ct := s.findContainer(ref); ct != nil {
+		return ct.State
+	}
+	return ""
+}
+
+// SetGateway sets the gateway of a network, returned when it is inspected
+func (s *Server) SetGateway(network, gateway string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gateways[network] = gateway
+}
+
+// SetExitCode sets the exit code reported for exec instances
+func (s *Server) SetExitCode(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exitCode = code
+}
+
+// SetUnavailable makes all API requests fail as if the daemon were down
+func (s *Server) SetUnavailable(unavailable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unavailable = unavailable
+}
+
+// Execs returns the exec instances created so far
+func (s *Server) Execs() []Exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []Exec
+	for _, item := range s.execs {
+		result = append(result, *item)
+	}
+	return result
+}
+
+// Signals returns the signals sent to a container so far
+func (s *Server) Signals(id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.signals[id])
+}
+
+// Subscribers returns the number of connected event streams
+func (s *Server) Subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+// Emit sends an event to all connected event streams, dropping it for streams that lag behind
+func (s *Server) Emit(msg events.Message) {
+	s.mu.Lock()
+	subscribers := slices.Clone(s.subscribers)
+	s.mu.Unlock()
+	for _, ch := range subscribers {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// EmitContainer sends a container event carrying the container name and labels
+func (s *Server) EmitContainer(action events.Action, ct container.Summary) {
+	attributes := map[string]string{"name": strings.TrimPrefix(ct.Names[0], "/")}
+	for key, value := range ct.Labels {
+		attributes[key] = value
+	}
+	s.Emit(events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: ct.ID, Attributes: attributes},
+	})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	unavailable := s.unavailable
+	s.mu.Unlock()
+	if unavailable {
+		writeError(w, http.StatusServiceUnavailable, "daemon is unavailable")
+		return
+	}
+
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/_ping":
+		w.Header().Set("Api-Version", APIVersion)
+		w.Header().Set("Ostype", "linux")
+		w.Write([]byte("OK"))
+	case path == "/containers/json" && r.Method == http.MethodGet:
+		s.handleContainerList(w, r)
+	case path == "/events" && r.Method == http.MethodGet:
+		s.handleEvents(w, r)
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "json" && r.Method == http.MethodGet:
+		s.handleContainerInspect(w, parts[1])
+	case len(parts) == 2 && parts[0] == "networks" && r.Method == http.MethodGet:
+		s.handleNetworkInspect(w, parts[1])
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "start" && r.Method == http.MethodPost:
+		s.handleContainerState(w, parts[1], "running")
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "stop" && r.Method == http.MethodPost:
+		s.handleContainerState(w, parts[1], "exited")
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "kill" && r.Method == http.MethodPost:
+		s.handleContainerKill(w, parts[1], r.URL.Query().Get("signal"))
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "stats" && r.Method == http.MethodGet:
+		s.handleContainerStats(w, parts[1])
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "exec" && r.Method == http.MethodPost:
+		s.handleExecCreate(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "start" && r.Method == http.MethodPost:
+		s.handleExecStart(w, parts[1])
+	case len(parts) == 3 && parts[0] == "exec" && parts[2] == "json" && r.Method == http.MethodGet:
+		s.handleExecInspect(w, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("page not found: %s %s", r.Method, path))
+	}
+}
+
+func (s *Server) handleContainerList(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []container.Summary{}
+	for _, ct := range s.containers {
+		if matchContainer(args, ct) {
+			result = append(result, ct)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleContainerInspect(w http.ResponseWriter, ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.findContainer(ref)
+	if ct == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", ref))
+		return
+	}
+	state := &container.State{
+		Status:  ct.State,
+		Running: ct.State == "running",
+	}
+	if status, exists := s.health[ct.ID]; exists {
+		state.Health = &container.Health{Status: status}
+	}
+	writeJSON(w, http.StatusOK, container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{
+			ID:    ct.ID,
+			Name:  ct.Names[0],
+			Image: ct.Image,
+			State: state,
+		},
+		Config: &container.Config{
+			Image:  ct.Image,
+			Labels: ct.Labels,
+			Env:    s.env[ct.ID],
+		},
+	})
+}
+
+func (s *Server) handleContainerState(w http.ResponseWriter, ref, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.findContainer(ref)
+	if ct == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", ref))
+		return
+	}
+	ct.State = state
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleContainerStats(w http.ResponseWriter, ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.findContainer(ref)
+	if ct == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", ref))
+		return
+	}
+	writeJSON(w, http.StatusOK, container.StatsResponse{
+		ID:       ct.ID,
+		Networks: map[string]container.NetworkStats{"eth0": {RxBytes: s.traffic[ct.ID]}},
+	})
+}
+
+func (s *Server) handleNetworkInspect(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gateway, exists := s.gateways[name]
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("network %s not found", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, network.Inspect{
+		Name: name,
+		ID:   name,
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Gateway: gateway}}},
+	})
+}
+
+// matchContainer applies the network, status and label filters used by caddy-gen
+func matchContainer(args filters.Args, ct container.Summary) bool {
+	if args.Contains("status") && !args.ExactMatch("status", ct.State) {
+		return false
+	}
+	if !args.MatchKVList("label", ct.Labels) {
+		return false
+	}
+	if args.Contains("network") {
+		if ct.NetworkSettings == nil {
+			return false
+		}
+		matched := false
+		for name := range ct.NetworkSettings.Networks {
+			if args.ExactMatch("network", name) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ch := make(chan events.Message, 16)
+	s.mu.Lock()
+	s.subscribers = append(s.subscribers, ch)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.subscribers = slices.DeleteFunc(s.subscribers, func(item chan events.Message) bool { return item == ch })
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case msg := <-ch:
+			if !matchEvent(args, msg) {
+				continue
+			}
+			if err := encoder.Encode(msg); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// matchEvent applies the type, event and label filters used by caddy-gen
+func matchEvent(args filters.Args, msg events.Message) bool {
+	if args.Contains("type") && !args.ExactMatch("type", string(msg.Type)) {
+		return false
+	}
+	if args.Contains("event") && !args.ExactMatch("event", string(msg.Action)) {
+		return false
+	}
+	return args.MatchKVList("label", msg.Actor.Attributes)
+}
+
+func (s *Server) handleContainerKill(w http.ResponseWriter, ref, signal string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.findContainer(ref)
+	if ct == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", ref))
+		return
+	}
+	s.signals[ct.ID] = append(s.signals[ct.ID], signal)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleExecCreate(w http.ResponseWriter, r *http.Request, containerID string) {
+	var options container.ExecOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.findContainer(containerID)
+	if ct == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", containerID))
+		return
+	}
+	exec := &Exec{
+		ID:          fmt.Sprintf("exec-%d", len(s.execs)+1),
+		ContainerID: ct.ID,
+		Options:     options,
+	}
+	s.execs = append(s.execs, exec)
+	writeJSON(w, http.StatusCreated, container.ExecCreateResponse{ID: exec.ID})
+}
+
+func (s *Server) handleExecStart(w http.ResponseWriter, execID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exec := s.findExec(execID)
+	if exec == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such exec instance: %s", execID))
+		return
+	}
+	exec.Started = true
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleExecInspect(w http.ResponseWriter, execID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exec := s.findExec(execID)
+	if exec == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such exec instance: %s", execID))
+		return
+	}
+	writeJSON(w, http.StatusOK, container.ExecInspect{
+		ExecID:      exec.ID,
+		ContainerID: exec.ContainerID,
+		Running:     false,
+		ExitCode:    s.exitCode,
+	})
+}
+
+// findContainer finds a container by ID or name, the lock must be held
+func (s *Server) findContainer(ref string) *container.Summary {
+	for i, ct := range s.containers {
+		if ct.ID == ref || slices.Contains(ct.Names, "/"+ref) {
+			return &s.containers[i]
+		}
+	}
+	return nil
+}
+
+// findExec finds an exec instance by ID, the lock must be held
+func (s *Server) findExec(id string) *Exec {
+	for _, exec := range s.execs {
+		if exec.ID == id {
+			return exec
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
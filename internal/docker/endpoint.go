@@ -0,0 +1,134 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/gera2ld/caddy-gen/internal/config"
+)
+
+// endpoint is a Docker daemon watched by caddy-gen
+type endpoint struct {
+	name    string
+	client  *client.Client
+	address string
+	network string
+
+	mu         sync.Mutex
+	containers []Container // Last successful listing, served while the endpoint is down
+	gateway    string      // Gateway of the network, looked up once
+}
+
+// newEndpoint creates a Docker client for an endpoint, using the environment if no host is set
+func newEndpoint(cfg config.EndpointConfig, network string) (*endpoint, error) {
+	if cfg.Context != "" {
+		if err := loadContext(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if cfg.Host != "" {
+		opts = append(opts, client.WithHost(cfg.Host))
+	}
+	if cfg.TLSCACert != "" || cfg.TLSCert != "" || cfg.TLSKey != "" {
+		opts = append(opts, client.WithTLSClientConfig(cfg.TLSCACert, cfg.TLSCert, cfg.TLSKey))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Network != "" {
+		network = cfg.Network
+	}
+	name := cfg.Name
+	if name == "" {
+		name = cli.DaemonHost()
+	}
+	return &endpoint{
+		name:    name,
+		client:  cli,
+		address: cfg.Address,
+		network: network,
+	}, nil
+}
+
+// hostAddress returns the address of the Docker host to reach containers outside the network,
+// i.e. the endpoint address, the configured host address or the gateway of the network
+func (ep *endpoint) hostAddress(ctx context.Context, configured string) string {
+	if ep.address != "" {
+		return ep.address
+	}
+	if configured != "" {
+		return configured
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.gateway != "" {
+		return ep.gateway
+	}
+	info, err := ep.client.NetworkInspect(ctx, ep.network, network.InspectOptions{})
+	if err != nil {
+		log.Printf("Failed to find the gateway of network %s: %v", ep.network, err)
+		return ""
+	}
+	for _, ipam := range info.IPAM.Config {
+		if ipam.Gateway != "" {
+			ep.gateway = ipam.Gateway
+			break
+		}
+	}
+	return ep.gateway
+}
+
+// contextMeta is the subset of a Docker context's meta.json used by caddy-gen
+type contextMeta struct {
+	Endpoints struct {
+		Docker struct {
+			Host string `json:"Host"`
+		} `json:"docker"`
+	} `json:"Endpoints"`
+}
+
+// loadContext reads the host and TLS files of a Docker context created by the Docker CLI
+func loadContext(cfg *config.EndpointConfig) error {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to locate Docker config: %v", err)
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+	digest := sha256.Sum256([]byte(cfg.Context))
+	id := hex.EncodeToString(digest[:])
+	data, err := os.ReadFile(filepath.Join(configDir, "contexts", "meta", id, "meta.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read Docker context %s: %v", cfg.Context, err)
+	}
+	var meta contextMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("failed to parse Docker context %s: %v", cfg.Context, err)
+	}
+	if cfg.Host == "" {
+		cfg.Host = meta.Endpoints.Docker.Host
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.Context
+	}
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	if _, err := os.Stat(tlsDir); err == nil && cfg.TLSCACert == "" && cfg.TLSCert == "" {
+		cfg.TLSCACert = filepath.Join(tlsDir, "ca.pem")
+		cfg.TLSCert = filepath.Join(tlsDir, "cert.pem")
+		cfg.TLSKey = filepath.Join(tlsDir, "key.pem")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+)
+
+func TestLoadContext(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	digest := sha256.Sum256([]byte("prod"))
+	metaDir := filepath.Join(configDir, "contexts", "meta", hex.EncodeToString(digest[:]))
+	os.MkdirAll(metaDir, 0755)
+	os.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(`{"Name":"prod","Endpoints":{"docker":{"Host":"tcp://10.0.0.2:2376"}}}`), 0644)
+
+	cfg := config.EndpointConfig{Context: "prod"}
+	if err := loadContext(&cfg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if cfg.Host != "tcp://10.0.0.2:2376" || cfg.Name != "prod" {
+		t.Errorf("cfg = %+v; want Host=tcp://10.0.0.2:2376, Name=prod", cfg)
+	}
+	if cfg.TLSCACert != "" {
+		t.Errorf("cfg.TLSCACert = %s; want no TLS", cfg.TLSCACert)
+	}
+
+	// Test missing context
+	cfg = config.EndpointConfig{Context: "missing"}
+	if err := loadContext(&cfg); err == nil {
+		t.Errorf("loadContext() with missing context returned no error")
+	}
+}
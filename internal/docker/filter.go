@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+const projectLabel = "com.docker.compose.project"
+
+// selector decides which containers are managed by caddy-gen
+type selector struct {
+	filter       *config.FilterConfig
+	names        []*regexp.Regexp
+	excludeNames []*regexp.Regexp
+}
+
+// newSelector compiles the name patterns of a filter config
+func newSelector(filter *config.FilterConfig) (*selector, error) {
+	if filter == nil {
+		filter = &config.FilterConfig{}
+	}
+	names, err := compilePatterns(filter.Names)
+	if err != nil {
+		return nil, err
+	}
+	excludeNames, err := compilePatterns(filter.ExcludeNames)
+	if err != nil {
+		return nil, err
+	}
+	return &selector{
+		filter:       filter,
+		names:        names,
+		excludeNames: excludeNames,
+	}, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %v", pattern, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// Match reports whether a container with the given name and labels is managed
+func (s *selector) Match(name string, labels map[string]string) bool {
+	name = strings.TrimPrefix(name, "/")
+	for _, label := range s.filter.Labels {
+		if !source.MatchLabel(label, labels) {
+			return false
+		}
+	}
+	for _, label := range s.filter.ExcludeLabels {
+		if source.MatchLabel(label, labels) {
+			return false
+		}
+	}
+	if len(s.names) > 0 && !slices.ContainsFunc(s.names, func(re *regexp.Regexp) bool { return re.MatchString(name) }) {
+		return false
+	}
+	if slices.ContainsFunc(s.excludeNames, func(re *regexp.Regexp) bool { return re.MatchString(name) }) {
+		return false
+	}
+	project := labels[projectLabel]
+	if len(s.filter.Projects) > 0 && !slices.Contains(s.filter.Projects, project) {
+		return false
+	}
+	if slices.Contains(s.filter.ExcludeProjects, project) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+)
+
+func TestSelector(t *testing.T) {
+	sel, err := newSelector(&config.FilterConfig{
+		Labels:          []string{"caddy-gen.enable=true"},
+		ExcludeLabels:   []string{"caddy-gen.ignore"},
+		Names:           []string{"^web-", "^api-"},
+		ExcludeNames:    []string{"-debug$"},
+		ExcludeProjects: []string{"billing"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"/web-1", map[string]string{"caddy-gen.enable": "true"}, true},
+		{"/web-1", map[string]string{"caddy-gen.enable": "false"}, false},
+		{"/web-1", map[string]string{}, false},
+		{"/web-1", map[string]string{"caddy-gen.enable": "true", "caddy-gen.ignore": ""}, false},
+		{"/db-1", map[string]string{"caddy-gen.enable": "true"}, false},
+		{"/api-debug", map[string]string{"caddy-gen.enable": "true"}, false},
+		{"/api-1", map[string]string{"caddy-gen.enable": "true", projectLabel: "billing"}, false},
+		{"/api-1", map[string]string{"caddy-gen.enable": "true", projectLabel: "shop"}, true},
+	}
+	for _, test := range tests {
+		if got := sel.Match(test.name, test.labels); got != test.want {
+			t.Errorf("Match(%s, %v) = %v; want %v", test.name, test.labels, got, test.want)
+		}
+	}
+
+	// Test project allowlist
+	sel, _ = newSelector(&config.FilterConfig{Projects: []string{"shop"}})
+	if !sel.Match("web", map[string]string{projectLabel: "shop"}) || sel.Match("web", map[string]string{}) {
+		t.Errorf("Match() did not apply project allowlist")
+	}
+
+	// Test invalid pattern
+	if _, err := newSelector(&config.FilterConfig{Names: []string{"("}}); err == nil {
+		t.Errorf("newSelector() with invalid pattern returned no error")
+	}
+}
@@ -0,0 +1,93 @@
+package generator
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+)
+
+// Types of authentication providers
+const (
+	authForward = "forward_auth"
+	authBasic   = "basic_auth"
+)
+
+// parseAuthProvider validates the value of the virtual.auth label
+func (g *Generator) parseAuthProvider(raw string) (string, error) {
+	name := strings.TrimSpace(raw)
+	if name == "" {
+		return "", nil
+	}
+	provider, exists := g.config.AuthProviders[name]
+	if !exists {
+		return "", fmt.Errorf("unknown auth provider: %s", name)
+	}
+	switch provider.Type {
+	case authForward:
+		if provider.URL == "" {
+			return "", fmt.Errorf("auth provider %s has no url", name)
+		}
+	case authBasic:
+		if _, err := g.readUsers(provider); err != nil {
+			return "", fmt.Errorf("auth provider %s: %v", name, err)
+		}
+	default:
+		return "", fmt.Errorf("auth provider %s has unknown type: %s", name, provider.Type)
+	}
+	return name, nil
+}
+
+// readUsers reads the users of a basic_auth provider from its secret file
+func (g *Generator) readUsers(provider config.AuthProvider) ([]string, error) {
+	content, err := g.secrets.ReadFile(provider.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.ContainsAny(line, "{}") {
+			return nil, fmt.Errorf("invalid line in users file %s, want USER HASH", provider.UsersFile)
+		}
+		users = append(users, strings.Join(fields, " "))
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no user in users file %s", provider.UsersFile)
+	}
+	return users, nil
+}
+
+// generateAuthDirectives expands the auth provider of a site config into directives placed before its reverse_proxy
+func (g *Generator) generateAuthDirectives(item SiteConfig) []string {
+	if item.Auth == "" {
+		return nil
+	}
+	provider := g.config.AuthProviders[item.Auth]
+	if provider.Type == authForward {
+		lines := []string{fmt.Sprintf("  forward_auth %s %s {", item.PathMatcher, provider.URL)}
+		if provider.URI != "" {
+			lines = append(lines, fmt.Sprintf("    uri %s", provider.URI))
+		}
+		if len(provider.CopyHeaders) > 0 {
+			lines = append(lines, fmt.Sprintf("    copy_headers %s", strings.Join(provider.CopyHeaders, " ")))
+		}
+		return append(lines, "  }")
+	}
+	users, err := g.readUsers(provider)
+	if err != nil {
+		// Fail closed rather than exposing the route without authentication
+		log.Printf("Auth provider %s of %s unavailable: %v", item.Auth, item.Name, err)
+		return []string{fmt.Sprintf("  error %s \"Authentication unavailable\" 503", item.PathMatcher)}
+	}
+	lines := []string{fmt.Sprintf("  basic_auth %s {", item.PathMatcher)}
+	for _, user := range users {
+		lines = append(lines, fmt.Sprintf("    %s", user))
+	}
+	return append(lines, "  }")
+}
@@ -0,0 +1,102 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// shouldAutoExpose reports whether an unlabeled container is exposed by default
+func (g *Generator) shouldAutoExpose(record source.Record) bool {
+	// Stopped containers list no ports to choose from
+	if !g.config.AutoExpose || !record.Running() {
+		return false
+	}
+	if _, exists := record.Labels["virtual.bind"]; exists {
+		return false
+	}
+	// Containers with L4 routes speak other protocols than HTTP
+	if _, exists := record.Labels["virtual.l4"]; exists {
+		return false
+	}
+	if optIn, err := strconv.ParseBool(record.Labels["virtual.expose"]); err == nil && !optIn {
+		return false
+	}
+	return true
+}
+
+// exposedTCPPorts returns the distinct private TCP ports of a container
+func exposedTCPPorts(record source.Record) []int {
+	seen := make(map[int]bool)
+	var ports []int
+	for _, port := range record.Ports {
+		if port.Protocol != "tcp" || seen[port.Private] {
+			continue
+		}
+		seen[port.Private] = true
+		ports = append(ports, port.Private)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// ambiguousPortsError reports a container skipped by auto-exposure
+type ambiguousPortsError struct {
+	ports []int
+}
+
+func (e *ambiguousPortsError) Error() string {
+	var candidates []string
+	for _, port := range e.ports {
+		candidates = append(candidates, strconv.Itoa(port))
+	}
+	return fmt.Sprintf("ambiguous ports %s", strings.Join(candidates, ", "))
+}
+
+// errNoExposedPort reports a container without port to infer
+var errNoExposedPort = errors.New("no exposed TCP port")
+
+// inferPort returns the default port of the image of a container, or else its only exposed TCP port
+func (g *Generator) inferPort(record source.Record) (int, error) {
+	if port, exists := g.imagePort(record.Image); exists {
+		return port, nil
+	}
+	ports := exposedTCPPorts(record)
+	switch len(ports) {
+	case 0:
+		return 0, errNoExposedPort
+	case 1:
+		return ports[0], nil
+	}
+	return 0, &ambiguousPortsError{ports: ports}
+}
+
+// imagePort returns the configured default port of an image, with or without its tag
+func (g *Generator) imagePort(image string) (int, bool) {
+	if port, exists := g.config.ImagePorts[image]; exists {
+		return port, true
+	}
+	name, _, _ := strings.Cut(image, "@")
+	// A colon after the last slash separates the tag, others belong to the registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	port, exists := g.config.ImagePorts[name]
+	return port, exists
+}
+
+// autoExposeContainer binds the inferred port of a container to the default hostname
+func (g *Generator) autoExposeContainer(record source.Record) ([]SiteConfig, error) {
+	port, err := g.inferPort(record)
+	if errors.Is(err, errNoExposedPort) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.parseBind(record, strconv.Itoa(port))
+}
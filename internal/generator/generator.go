@@ -1,15 +1,20 @@
 package generator
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
-	"github.com/docker/docker/api/types/container"
 	"github.com/gera2ld/caddy-gen/internal/config"
-	"github.com/gera2ld/caddy-gen/internal/docker"
+	"github.com/gera2ld/caddy-gen/internal/secrets"
+	"github.com/gera2ld/caddy-gen/internal/source"
 )
 
 type SiteConfig struct {
@@ -19,46 +24,144 @@ type SiteConfig struct {
 	Name            string
 	HostDirectives  []string
 	ProxyDirectives []string
-	ProxyIP         string
+	ProxyIPs        []string
+	TLS             string
+	Auth            string
+	Route           string   // Kind of route, empty for reverse_proxy
+	Target          string   // Target URL of redir routes, socket path of unix upstreams
+	Status          string   // Status code of redir and respond routes
+	Scheme          string   // Scheme of the upstream, empty for plain HTTP
+	Transport       []string // Subdirectives of the transport block
+	Origin          string   // Origin of the record, used by wake up routes
 }
 
 type Generator struct {
-	docker *docker.Client
-	config *config.Config
+	source    source.Source
+	config    *config.Config
+	secrets   *secrets.Resolver
+	ownership []ownershipRule
+
+	secretRules map[*config.PolicyConfig][]secretRule
 }
 
-func NewGenerator(dockerClient *docker.Client, cfg *config.Config) *Generator {
+func NewGenerator(src source.Source, cfg *config.Config) *Generator {
 	return &Generator{
-		docker: dockerClient,
-		config: cfg,
+		source:    src,
+		config:    cfg,
+		secrets:   secrets.NewResolver(cfg.SecretsDir),
+		ownership: compileOwnership(cfg.Ownership),
+
+		secretRules: compileSecretRules(cfg.Policy),
 	}
 }
 
+// Output is the generated configuration
+type Output struct {
+	Sites string // Site or handle blocks of HTTP routes
+	L4    string // layer4 app of TCP and UDP routes, empty if L4 output is disabled
+}
+
 func (g *Generator) GenerateConfig() (string, error) {
-	containers, err := g.docker.ListContainers()
+	output, err := g.Generate()
 	if err != nil {
-		return "", fmt.Errorf("failed to list containers: %v", err)
+		return "", err
 	}
-	siteConfigs := g.processSiteConfigs(containers)
+	return output.Sites, nil
+}
+
+// Generate generates the HTTP and L4 configuration from the same records
+func (g *Generator) Generate() (*Output, error) {
+	records, err := g.source.Records()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+	siteConfigs := g.processSiteConfigs(records)
 	groups := g.groupSiteConfigs(siteConfigs)
-	return g.generateCaddyConfig(groups), nil
+	output := &Output{Sites: g.generateCaddyConfig(groups)}
+	if g.config.L4OutFile != "" {
+		output.L4 = g.generateL4Config(g.processL4Configs(records))
+	}
+	return output, nil
 }
 
-func (g *Generator) processSiteConfigs(containers []container.Summary) []SiteConfig {
+func (g *Generator) processSiteConfigs(records []source.Record) []SiteConfig {
 	var siteConfigs []SiteConfig
-	for _, ct := range containers {
-		configs, err := g.processContainer(ct)
+	var skipped []string
+	for _, record := range records {
+		configs, err := g.processRecord(record)
+		if err == nil {
+			// A record violating the policy or missing secrets is rejected as a whole
+			err = g.checkRecord(record, configs)
+		}
 		if err != nil {
-			log.Printf("Site config error: %s", err)
+			// Configs parsed before an error are incomplete and unchecked
+			configs = nil
+		}
+		configs = g.toStopped(record, g.checkOwnership(record, configs))
+		var ambiguous *ambiguousPortsError
+		if errors.As(err, &ambiguous) {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", record.Name, err))
+		} else if err != nil {
+			log.Printf("Site config error in %s: %s", record.Name, err)
 		}
 		siteConfigs = append(siteConfigs, configs...)
 	}
-	return siteConfigs
+	if len(skipped) > 0 {
+		log.Printf("Auto-expose skipped %d containers: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+	return dropShadowedStopped(siteConfigs)
+}
+
+// processRecord creates the site configs of a record, a panic is turned into an error of the record
+func (g *Generator) processRecord(record source.Record) (configs []SiteConfig, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			configs = nil
+			err = fmt.Errorf("panic while parsing labels: %v", r)
+		}
+	}()
+	if !record.Running() && g.stoppedRoute(record) == "" {
+		return nil, nil
+	}
+	if g.shouldAutoExpose(record) {
+		return g.autoExposeContainer(record)
+	}
+	return g.processContainer(record)
+}
+
+// checkRecord verifies the site configs of a record against the policy and the secrets
+func (g *Generator) checkRecord(record source.Record, configs []SiteConfig) error {
+	if err := g.checkPolicy(record, configs); err != nil {
+		return err
+	}
+	return g.checkSecrets(configs)
+}
+
+// checkSecrets verifies that the secrets referenced by labels and the snippets they use exist
+func (g *Generator) checkSecrets(configs []SiteConfig) error {
+	for _, item := range configs {
+		texts := labelTexts(item)
+		texts = append(texts, g.expandSnippets(item.HostDirectives)...)
+		texts = append(texts, g.expandSnippets(item.ProxyDirectives)...)
+		for _, text := range texts {
+			if err := g.secrets.Check(text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (g *Generator) groupSiteConfigs(siteConfigs []SiteConfig) map[string][]SiteConfig {
 	groups := make(map[string][]SiteConfig)
 	for _, item := range siteConfigs {
+		if g.config.Mode == config.ModeSite {
+			// Each hostname gets its own site block so host directives apply per site
+			for _, hostname := range item.Hostnames {
+				groups[hostname] = append(groups[hostname], item)
+			}
+			continue
+		}
 		key := strings.Join(item.Hostnames, " ")
 		groups[key] = append(groups[key], item)
 	}
@@ -75,18 +178,35 @@ func (g *Generator) generateCaddyConfig(groups map[string][]SiteConfig) string {
 	var configParts []string
 	for i, hostnames := range keys {
 		group := groups[hostnames]
-		configParts = append(configParts, g.generateHostConfig(hostnames, group, i))
+		// Secrets are resolved last so they never appear in site configs or logs,
+		// a secret failing to resolve drops its block only
+		part, err := g.secrets.Expand(g.generateHostConfig(hostnames, group, i))
+		if err != nil {
+			log.Printf("Dropped config of %s, failed to resolve secrets: %v", hostnames, err)
+			continue
+		}
+		configParts = append(configParts, part)
 	}
 	return strings.Join(configParts, "\n\n")
 }
 
 func (g *Generator) generateHostConfig(hostnames string, group []SiteConfig, index int) string {
-	hostMatcher := fmt.Sprintf("@caddy-gen-%d", index)
 	var sectionLines []string
-	sectionLines = append(sectionLines, fmt.Sprintf("%s host %s", hostMatcher, hostnames))
-	sectionLines = append(sectionLines, fmt.Sprintf("handle %s {", hostMatcher))
+	tlsPolicy := g.groupTLSPolicy(hostnames, group)
+	if g.config.Mode == config.ModeSite {
+		sectionLines = append(sectionLines, fmt.Sprintf("%s {", g.siteAddress(hostnames, tlsPolicy)))
+		sectionLines = append(sectionLines, g.generateTLSDirectives(tlsPolicy)...)
+	} else {
+		hostMatcher := fmt.Sprintf("@caddy-gen-%d", index)
+		sectionLines = append(sectionLines, fmt.Sprintf("%s host %s", hostMatcher, hostnames))
+		sectionLines = append(sectionLines, fmt.Sprintf("handle %s {", hostMatcher))
+	}
 	sectionLines = append(sectionLines, g.generateDirectives(group, "host")...)
 	sectionLines = append(sectionLines, g.generateDirectives(group, "proxy")...)
+	if g.config.Mode == config.ModeSite {
+		// Error handlers are only allowed at the top level of sites
+		sectionLines = append(sectionLines, g.generateErrorDirectives()...)
+	}
 	sectionLines = append(sectionLines, "}")
 	return strings.Join(sectionLines, "\n")
 }
@@ -95,30 +215,53 @@ func (g *Generator) generateDirectives(group []SiteConfig, directiveType string)
 	var lines []string
 	for _, item := range group {
 		if directiveType == "host" {
-			for _, directive := range item.HostDirectives {
+			for _, directive := range g.expandSnippets(item.HostDirectives) {
 				lines = append(lines, fmt.Sprintf("  %s", directive))
 			}
 		} else {
 			lines = append(lines, fmt.Sprintf("  # %s", item.Name))
+			lines = append(lines, g.generateAuthDirectives(item)...)
+			if item.Route != "" {
+				lines = append(lines, g.generateRouteDirectives(item)...)
+				continue
+			}
 			lines = append(lines, fmt.Sprintf("  reverse_proxy %s {", item.PathMatcher))
-			for _, directive := range item.ProxyDirectives {
+			for _, directive := range g.expandSnippets(item.ProxyDirectives) {
 				lines = append(lines, fmt.Sprintf("    %s", directive))
 			}
-			lines = append(lines, fmt.Sprintf("    to %s:%d", item.ProxyIP, item.Port))
+			lines = append(lines, generateTransport(item)...)
+			lines = append(lines, fmt.Sprintf("    to %s", strings.Join(upstreamAddresses(item), " ")))
 			lines = append(lines, "  }")
 		}
 	}
 	return lines
 }
 
-func (g *Generator) processContainer(ct container.Summary) ([]SiteConfig, error) {
-	var configs []SiteConfig
-	rawBind, exists := ct.Labels["virtual.bind"]
+func (g *Generator) processContainer(record source.Record) ([]SiteConfig, error) {
+	rawBind, exists := record.Labels["virtual.bind"]
 	if !exists || strings.TrimSpace(rawBind) == "" {
-		return configs, nil
+		return nil, nil
+	}
+	rawBind, err := expandEnv(rawBind, record.Env)
+	if err != nil {
+		return nil, err
+	}
+	return g.parseBind(record, rawBind)
+}
+
+func (g *Generator) parseBind(record source.Record, rawBind string) ([]SiteConfig, error) {
+	var configs []SiteConfig
+	tlsPolicy, err := g.parseTLSPolicy(record.Labels["virtual.tls"])
+	if err != nil {
+		return configs, err
+	}
+	auth, err := g.parseAuthProvider(record.Labels["virtual.auth"])
+	if err != nil {
+		return configs, err
 	}
 	lines := strings.Split(rawBind, "\n")
 	var config *SiteConfig = nil
+	var vars map[string]string
 	brackets := 0
 	offset := 0
 	for offset < len(lines) {
@@ -129,26 +272,23 @@ func (g *Generator) processContainer(ct container.Summary) ([]SiteConfig, error)
 			continue
 		}
 
-		// Check if line is a new port binding
+		// Check if line is a new binding
 		parts := strings.Fields(line)
-		port, err := strconv.Atoi(parts[0])
-		if err == nil {
-			var proxyIP string
-			if networkSettings, exists := ct.NetworkSettings.Networks[g.config.Network]; exists {
-				proxyIP = networkSettings.IPAddress
+		if isBindTarget(parts[0]) {
+			if vars == nil {
+				vars = g.templateVars(record)
+			}
+			items, err := g.parseBindLine(record, parts, vars)
+			if err != nil {
+				return configs, err
 			}
-			configs = append(configs, SiteConfig{
-				Name:    strings.TrimPrefix(ct.Names[0], "/"),
-				Port:    port,
-				ProxyIP: proxyIP,
-			})
-			config = &configs[len(configs)-1]
-			if strings.HasPrefix(parts[1], "/") {
-				config.PathMatcher = parts[1]
-				config.Hostnames = parts[2:]
-			} else {
-				config.Hostnames = parts[1:]
+			for i := range items {
+				items[i].TLS = tlsPolicy
 			}
+			items[0].Auth = auth
+			configs = append(configs, items...)
+			// Directives apply to the main route rather than canonical redirects
+			config = &configs[len(configs)-len(items)]
 			continue
 		}
 
@@ -158,8 +298,12 @@ func (g *Generator) processContainer(ct container.Summary) ([]SiteConfig, error)
 			continue
 		}
 
-		// Directives can be wrapped with brackets
-		if strings.HasSuffix(line, "{") {
+		// Directives can be wrapped with brackets, a closing one would end the enclosing block
+		tokens := lineTokens(strings.TrimPrefix(line, "host:"))
+		if len(tokens) > 0 && tokens[0] == "}" {
+			return configs, fmt.Errorf("unbalanced closing bracket: %s", line)
+		}
+		if opensBlock(tokens) {
 			brackets += 1
 		}
 		directive := line
@@ -167,23 +311,162 @@ func (g *Generator) processContainer(ct container.Summary) ([]SiteConfig, error)
 			line = lines[offset]
 			offset += 1
 			directive += "\n" + line
-			if strings.TrimSpace(line) == "}" {
+			tokens := lineTokens(line)
+			if len(tokens) > 0 && tokens[0] == "}" {
 				brackets -= 1
+			} else if opensBlock(tokens) {
+				brackets += 1
 			}
 		}
 		if brackets > 0 {
 			return configs, fmt.Errorf("unexpected end of config")
 		}
-		g.processDirective(directive, config)
+		if err := g.processDirective(directive, config); err != nil {
+			return configs, err
+		}
 	}
 	return configs, nil
 }
 
-func (g *Generator) processDirective(directive string, config *SiteConfig) {
+// lineTokens splits a line into Caddyfile tokens up to a comment, quoted tokens are kept whole with their quotes
+func lineTokens(line string) []string {
+	var tokens []string
+	var token strings.Builder
+	var quote rune
+	inToken, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case quote != 0:
+			token.WriteRune(r)
+			if r == '\\' && quote == '"' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '`':
+			quote = r
+			token.WriteRune(r)
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		case r == '#' && !inToken:
+			return tokens
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// opensBlock reports whether a line ends with an opening bracket, ignoring a trailing comment
+func opensBlock(tokens []string) bool {
+	return len(tokens) > 0 && tokens[len(tokens)-1] == "{"
+}
+
+// parseBindLine creates the site configs of a bind line, i.e. the route and its canonical redirects
+func (g *Generator) parseBindLine(record source.Record, parts []string, vars map[string]string) ([]SiteConfig, error) {
+	var args []string
+	options := make(map[string]string)
+	for _, part := range parts[1:] {
+		if key, value, found := strings.Cut(part, "="); found {
+			options[key] = value
+		} else {
+			args = append(args, part)
+		}
+	}
+	config := SiteConfig{Name: record.Name}
+	if err := g.parseRouteTarget(record, parts[0], &config); err != nil {
+		return nil, err
+	}
+	if err := parseRouteOptions(options, &config); err != nil {
+		return nil, err
+	}
+	if len(args) > 0 && strings.HasPrefix(args[0], "/") {
+		config.PathMatcher = args[0]
+		args = args[1:]
+	}
+	var err error
+	config.Hostnames, err = g.expandHostnames(args, vars)
+	if err != nil {
+		return nil, err
+	}
+	if canonical := options["canonical"]; canonical != "" {
+		return canonicalize(config, canonical)
+	}
+	return []SiteConfig{config}, nil
+}
+
+func (g *Generator) processDirective(directive string, config *SiteConfig) error {
 	directive = strings.TrimSpace(directive)
-	if strings.HasPrefix(directive, "host:") {
-		config.HostDirectives = append(config.HostDirectives, strings.TrimSpace(directive[5:]))
+	isHost := strings.HasPrefix(directive, "host:")
+	if isHost {
+		directive = strings.TrimSpace(directive[5:])
+	} else if config.Route == routeRedir {
+		return fmt.Errorf("redir routes take no proxy directives: %s", directive)
+	}
+	if err := g.checkSnippet(directive); err != nil {
+		return err
+	}
+	if isHost {
+		config.HostDirectives = append(config.HostDirectives, directive)
 	} else {
 		config.ProxyDirectives = append(config.ProxyDirectives, directive)
 	}
+	return nil
+}
+
+// resolveUpstream returns the addresses and port to reach a target port,
+// targets of remote endpoints or outside the network are reached through the host
+func (g *Generator) resolveUpstream(record source.Record, port int, protocol string) ([]string, int, error) {
+	if record.HostNetwork && record.HostAddress != "" {
+		return []string{record.HostAddress}, port, nil
+	}
+	if record.HostAddress != "" {
+		for _, item := range record.Ports {
+			if item.Private == port && item.Public != 0 && item.Protocol == protocol {
+				return []string{record.HostAddress}, item.Public, nil
+			}
+		}
+		return nil, 0, fmt.Errorf("port %d/%s of %s on %s is not published", port, protocol, record.Name, record.Origin)
+	}
+	ips := g.selectIPs(record)
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("%s is not reachable, it has no address on the network and the host address is unknown", record.Name)
+	}
+	return ips, port, nil
+}
+
+// selectIPs returns the addresses of a target on the network according to the IP preference,
+// falling back to the other family for single-stack targets
+func (g *Generator) selectIPs(record source.Record) []string {
+	var ips []string
+	switch g.config.IPPreference {
+	case config.Dual:
+		ips = []string{record.IP, record.IPv6}
+	case config.IPv6:
+		ips = []string{cmp.Or(record.IPv6, record.IP)}
+	default:
+		ips = []string{cmp.Or(record.IP, record.IPv6)}
+	}
+	return slices.DeleteFunc(ips, func(ip string) bool { return ip == "" })
+}
+
+// joinHostPort formats upstream addresses, with brackets around IPv6 literals
+func joinHostPort(hosts []string, port int) []string {
+	var addresses []string
+	for _, host := range hosts {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addresses
 }
@@ -1,37 +1,33 @@
 package generator
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/network"
 	"github.com/gera2ld/caddy-gen/internal/config"
-	"github.com/gera2ld/caddy-gen/internal/docker"
+	"github.com/gera2ld/caddy-gen/internal/source"
 )
 
 func TestParseBindInfo(t *testing.T) {
-	// Create test container
-	container := container.Summary{
-		Names:  []string{"/test-container"},
+	// Create test record
+	record := source.Record{
+		Name:   "test-container",
 		Labels: map[string]string{},
-		NetworkSettings: &container.NetworkSettingsSummary{
-			Networks: map[string]*network.EndpointSettings{
-				"gateway": {
-					IPAddress: "172.17.0.2",
-				},
-			},
-		},
+		IP:     "172.17.0.2",
 	}
 
 	// Create generator
 	cfg := &config.Config{Network: "gateway"}
-	dockerClient := &docker.Client{} // Mock client
-	generator := NewGenerator(dockerClient, cfg)
+	generator := NewGenerator(source.NewMemory(), cfg)
 
 	// Test simple bind
-	container.Labels["virtual.bind"] = "80 example.com"
-	configs, err := generator.processContainer(container)
+	record.Labels["virtual.bind"] = "80 example.com"
+	configs, err := generator.processContainer(record)
 	if err != nil {
 		t.Errorf("Error: %s", err)
 	}
@@ -51,13 +47,13 @@ func TestParseBindInfo(t *testing.T) {
 	if siteConfig.Name != "test-container" {
 		t.Errorf("siteConfig.Name = %s; want test-container", siteConfig.Name)
 	}
-	if siteConfig.ProxyIP != "172.17.0.2" {
-		t.Errorf("siteConfig.ProxyIP = %s; want 172.17.0.2", siteConfig.ProxyIP)
+	if !slices.Equal(siteConfig.ProxyIPs, []string{"172.17.0.2"}) {
+		t.Errorf("siteConfig.ProxyIPs = %v; want [172.17.0.2]", siteConfig.ProxyIPs)
 	}
 
 	// Test bind with path
-	container.Labels["virtual.bind"] = "80 /api example.com"
-	configs, err = generator.processContainer(container)
+	record.Labels["virtual.bind"] = "80 /api example.com"
+	configs, err = generator.processContainer(record)
 	if err != nil {
 		t.Errorf("Error: %s", err)
 	}
@@ -70,12 +66,12 @@ func TestParseBindInfo(t *testing.T) {
 	}
 
 	// Test bind with directives
-	container.Labels["virtual.bind"] = `80 example.com
+	record.Labels["virtual.bind"] = `80 example.com
 header Server "My Server"
 host:tls {
 internal
 }`
-	configs, err = generator.processContainer(container)
+	configs, err = generator.processContainer(record)
 	if err != nil {
 		t.Errorf("Error: %s", err)
 	}
@@ -92,8 +88,8 @@ internal
 	}
 
 	// Test invalid bind
-	container.Labels["virtual.bind"] = "Invalid"
-	configs, err = generator.processContainer(container)
+	record.Labels["virtual.bind"] = "Invalid"
+	configs, err = generator.processContainer(record)
 	if err != nil {
 		t.Errorf("Error: %s", err)
 	}
@@ -103,29 +99,22 @@ internal
 }
 
 func TestProcessContainer(t *testing.T) {
-	// Create test container
-	container := container.Summary{
-		Names: []string{"/test-container"},
+	// Create test record
+	record := source.Record{
+		Name: "test-container",
 		Labels: map[string]string{
 			"virtual.bind": `80 example.com
 8080 /api api.example.com`,
 		},
-		NetworkSettings: &container.NetworkSettingsSummary{
-			Networks: map[string]*network.EndpointSettings{
-				"gateway": {
-					IPAddress: "172.17.0.2",
-				},
-			},
-		},
+		IP: "172.17.0.2",
 	}
 
 	// Create generator
 	cfg := &config.Config{Network: "gateway"}
-	dockerClient := &docker.Client{} // Mock client
-	generator := NewGenerator(dockerClient, cfg)
+	generator := NewGenerator(source.NewMemory(), cfg)
 
 	// Test process container
-	configs, err := generator.processContainer(container)
+	configs, err := generator.processContainer(record)
 	if err != nil {
 		t.Errorf("Error: %s", err)
 	}
@@ -144,3 +133,1198 @@ func TestProcessContainer(t *testing.T) {
 	}
 }
 
+func TestGenerateSiteBlocks(t *testing.T) {
+	siteConfigs := []SiteConfig{
+		{Name: "web", Hostnames: []string{"example.com", "www.example.com"}, Port: 80, ProxyIPs: []string{"172.17.0.2"}, HostDirectives: []string{"tls internal"}},
+		{Name: "api", Hostnames: []string{"example.com"}, PathMatcher: "/api", Port: 8080, ProxyIPs: []string{"172.17.0.3"}},
+	}
+
+	// Handle mode groups by the full hostname list
+	generator := NewGenerator(source.NewMemory(), &config.Config{Network: "gateway", Mode: config.ModeHandle})
+	groups := generator.groupSiteConfigs(siteConfigs)
+	if len(groups) != 2 {
+		t.Errorf("handle mode groups = %v; want 2 groups", groups)
+	}
+
+	// Site mode emits one block per hostname
+	generator = NewGenerator(source.NewMemory(), &config.Config{Network: "gateway", Mode: config.ModeSite})
+	output := generator.generateCaddyConfig(generator.groupSiteConfigs(siteConfigs))
+	expected := `example.com {
+  tls internal
+  # web
+  reverse_proxy  {
+    to 172.17.0.2:80
+  }
+  # api
+  reverse_proxy /api {
+    to 172.17.0.3:8080
+  }
+}
+
+www.example.com {
+  tls internal
+  # web
+  reverse_proxy  {
+    to 172.17.0.2:80
+  }
+}`
+	if output != expected {
+		t.Errorf("generateCaddyConfig() = %s; want %s", output, expected)
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	cfg := &config.Config{
+		Network: "gateway",
+		Mode:    config.ModeSite,
+		TLSIssuers: map[string]config.TLSIssuer{
+			"cloudflare": {Email: "admin@example.com", DNS: "cloudflare {env.CF_API_TOKEN}"},
+		},
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	record := source.Record{
+		Name: "test-container",
+		Labels: map[string]string{
+			"virtual.bind": "80 example.com",
+			"virtual.tls":  "cloudflare",
+		},
+		IP: "172.17.0.2",
+	}
+
+	// Test named issuer
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	output := generator.generateCaddyConfig(generator.groupSiteConfigs(configs))
+	expected := `example.com {
+  tls admin@example.com {
+    dns cloudflare {env.CF_API_TOKEN}
+  }
+  # test-container
+  reverse_proxy  {
+    to 172.17.0.2:80
+  }
+}`
+	if output != expected {
+		t.Errorf("generateCaddyConfig() = %s; want %s", output, expected)
+	}
+
+	// Test HTTP only
+	record.Labels["virtual.tls"] = "http"
+	configs, err = generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	output = generator.generateCaddyConfig(generator.groupSiteConfigs(configs))
+	if !strings.HasPrefix(output, "http://example.com {\n  # test-container") {
+		t.Errorf("generateCaddyConfig() = %s; want http:// site without tls", output)
+	}
+
+	// Test unknown issuer
+	record.Labels["virtual.tls"] = "unknown"
+	_, err = generator.processContainer(record)
+	if err == nil {
+		t.Errorf("processContainer() with unknown issuer returned no error")
+	}
+
+	// Test handle mode, where TLS is managed by the enclosing site
+	cfg.Mode = config.ModeHandle
+	record.Labels["virtual.tls"] = "internal"
+	configs, err = generator.processContainer(record)
+	if err == nil || err.Error() != "TLS policy internal requires site mode" {
+		t.Errorf("processContainer() = %+v, %v; want site mode error", configs, err)
+	}
+}
+
+func TestHostnameTemplates(t *testing.T) {
+	cfg := &config.Config{
+		Network:       "gateway",
+		DefaultDomain: "staging.example.com",
+		DefaultHost:   "{service}.{project}.{domain}",
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	record := source.Record{
+		Name: "shop-web-1",
+		Labels: map[string]string{
+			"com.docker.compose.project": "shop",
+			"com.docker.compose.service": "web",
+			"team":                       "sales",
+		},
+		IP: "172.17.0.2",
+	}
+
+	// Test default hostname
+	record.Labels["virtual.bind"] = "80"
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(configs) != 1 || len(configs[0].Hostnames) != 1 || configs[0].Hostnames[0] != "web.shop.staging.example.com" {
+		t.Errorf("configs = %+v; want Hostnames=[web.shop.staging.example.com]", configs)
+	}
+
+	// Test default hostname with path
+	record.Labels["virtual.bind"] = "80 /api"
+	configs, err = generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(configs) != 1 || configs[0].PathMatcher != "/api" || configs[0].Hostnames[0] != "web.shop.staging.example.com" {
+		t.Errorf("configs = %+v; want PathMatcher=/api, Hostnames=[web.shop.staging.example.com]", configs)
+	}
+
+	// Test templates in hostnames
+	record.Labels["virtual.bind"] = "80 {name}.{domain} {label.team}.example.com"
+	configs, err = generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(configs) != 1 || strings.Join(configs[0].Hostnames, " ") != "shop-web-1.staging.example.com sales.example.com" {
+		t.Errorf("configs = %+v; want Hostnames=[shop-web-1.staging.example.com sales.example.com]", configs)
+	}
+
+	// Test unknown variable
+	record.Labels["virtual.bind"] = "80 {label.missing}.example.com"
+	configs, err = generator.processContainer(record)
+	if err == nil || len(configs) != 0 {
+		t.Errorf("processContainer() = %+v, %v; want error", configs, err)
+	}
+}
+
+func TestAutoExpose(t *testing.T) {
+	cfg := &config.Config{
+		Network:       "gateway",
+		DefaultDomain: "dev.example.com",
+		DefaultHost:   "{name}.{domain}",
+		AutoExpose:    true,
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	records := []source.Record{
+		{
+			Name:   "single",
+			Labels: map[string]string{},
+			Ports:  []source.Port{{Private: 3000, Public: 3000, Protocol: "tcp"}, {Private: 3000, Public: 3000, Protocol: "tcp"}},
+			IP:     "172.17.0.2",
+		},
+		{
+			Name:   "ambiguous",
+			Labels: map[string]string{},
+			Ports:  []source.Port{{Private: 80, Protocol: "tcp"}, {Private: 443, Protocol: "tcp"}},
+			IP:     "172.17.0.3",
+		},
+		{
+			Name:   "opted-out",
+			Labels: map[string]string{"virtual.expose": "false"},
+			Ports:  []source.Port{{Private: 80, Protocol: "tcp"}},
+			IP:     "172.17.0.4",
+		},
+		{
+			Name:   "udp-only",
+			Labels: map[string]string{},
+			Ports:  []source.Port{{Private: 53, Protocol: "udp"}},
+			IP:     "172.17.0.5",
+		},
+		{
+			Name:   "postgres",
+			Labels: map[string]string{"virtual.l4": "5432 5432"},
+			Ports:  []source.Port{{Private: 5432, Protocol: "tcp"}},
+			IP:     "172.17.0.6",
+		},
+	}
+
+	configs := generator.processSiteConfigs(records)
+	if len(configs) != 1 {
+		t.Fatalf("processSiteConfigs() returned %d configs; want 1", len(configs))
+	}
+	if configs[0].Port != 3000 || configs[0].Hostnames[0] != "single.dev.example.com" {
+		t.Errorf("configs[0] = %+v; want Port=3000, Hostnames=[single.dev.example.com]", configs[0])
+	}
+
+	_, err := generator.autoExposeContainer(records[1])
+	if err == nil || err.Error() != "ambiguous ports 80, 443" {
+		t.Errorf("autoExposeContainer() = %v; want ambiguous ports 80, 443", err)
+	}
+}
+
+func TestRemoteEndpoint(t *testing.T) {
+	generator := NewGenerator(source.NewMemory(), &config.Config{Network: "gateway"})
+	record := source.Record{
+		Name: "remote",
+		Labels: map[string]string{
+			"virtual.bind": "80 remote.example.com",
+		},
+		Ports:       []source.Port{{Private: 80, Public: 8080, Protocol: "tcp"}},
+		Origin:      "edge",
+		HostAddress: "10.0.0.2",
+	}
+
+	// Test published port
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(configs) != 1 || !slices.Equal(configs[0].ProxyIPs, []string{"10.0.0.2"}) || configs[0].Port != 8080 {
+		t.Errorf("configs = %+v; want ProxyIPs=[10.0.0.2], Port=8080", configs)
+	}
+
+	// Test unpublished port
+	record.Labels["virtual.bind"] = "3000 remote.example.com"
+	configs, err = generator.processContainer(record)
+	if err == nil || len(configs) != 0 {
+		t.Errorf("processContainer() = %+v, %v; want error", configs, err)
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	src := source.NewMemory(source.Record{
+		Name:   "web",
+		Labels: map[string]string{"virtual.bind": "80 example.com"},
+		IP:     "172.17.0.2",
+	})
+	generator := NewGenerator(src, &config.Config{Network: "gateway", Mode: config.ModeHandle})
+
+	output, err := generator.GenerateConfig()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	expected := `@caddy-gen-0 host example.com
+handle @caddy-gen-0 {
+  # web
+  reverse_proxy  {
+    to 172.17.0.2:80
+  }
+}`
+	if output != expected {
+		t.Errorf("GenerateConfig() = %s; want %s", output, expected)
+	}
+
+	// Test updated records
+	src.Set()
+	output, err = generator.GenerateConfig()
+	if err != nil || output != "" {
+		t.Errorf("GenerateConfig() = %q, %v; want empty config", output, err)
+	}
+}
+
+func TestParseBindNestedBlocks(t *testing.T) {
+	generator := NewGenerator(source.NewMemory(), &config.Config{Network: "gateway"})
+	record := source.Record{
+		Name: "test-container",
+		Labels: map[string]string{
+			"virtual.bind": `80 example.com
+host:handle_errors {
+  handle {
+    respond "down"
+  }
+}
+header X-Test 1`,
+		},
+		IP: "172.17.0.2",
+	}
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(configs) != 1 || len(configs[0].HostDirectives) != 1 || len(configs[0].ProxyDirectives) != 1 {
+		t.Fatalf("configs = %+v; want 1 host directive and 1 proxy directive", configs)
+	}
+	if !strings.HasSuffix(configs[0].HostDirectives[0], "  }\n}") {
+		t.Errorf("HostDirectives[0] = %q; want the whole nested block", configs[0].HostDirectives[0])
+	}
+
+	// Test invalid ports
+	for _, bind := range []string{"0 example.com", "65536 example.com", "-80 example.com"} {
+		record.Labels["virtual.bind"] = bind
+		if configs, err := generator.processContainer(record); err == nil || len(configs) != 0 {
+			t.Errorf("processContainer(%q) = %+v, %v; want error", bind, configs, err)
+		}
+	}
+}
+
+// FuzzParseBind checks that no virtual.bind label makes the parser panic,
+// the seed corpus in testdata/fuzz/FuzzParseBind holds real-world labels
+func FuzzParseBind(f *testing.F) {
+	f.Add("80 example.com")
+	f.Add("80")
+	f.Add("80 /api example.com\nhost:tls {\ninternal\n}")
+	cfg := &config.Config{
+		Network:       "gateway",
+		Mode:          config.ModeSite,
+		DefaultDomain: "example.com",
+		DefaultHost:   "{name}.{domain}",
+		Snippets:      map[string][]string{"cors": {"header Access-Control-Allow-Origin {args[0]}"}},
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	f.Fuzz(func(t *testing.T, bind string) {
+		record := source.Record{
+			Name: "fuzz",
+			Labels: map[string]string{
+				"virtual.bind":               bind,
+				"com.docker.compose.service": "web",
+			},
+			IP: "172.17.0.2",
+		}
+		configs, _ := generator.processContainer(record)
+		for _, item := range configs {
+			if len(item.Hostnames) == 0 {
+				t.Errorf("config %+v has no hostname", item)
+			}
+			if item.Route == "" && item.Scheme != schemeUnix && (item.Port < 1 || item.Port > 65535) {
+				t.Errorf("config %+v has invalid port", item)
+			}
+		}
+		generator.generateCaddyConfig(generator.groupSiteConfigs(configs))
+	})
+}
+
+func TestSecrets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "api-token"), []byte("s3cr3t\n"), 0600)
+	src := source.NewMemory(
+		source.Record{
+			Name:   "web",
+			Labels: map[string]string{"virtual.bind": "80 example.com\nheader_up Authorization \"Bearer {secret.api-token}\""},
+			IP:     "172.17.0.2",
+		},
+		source.Record{
+			Name:   "broken",
+			Labels: map[string]string{"virtual.bind": "80 broken.example.com\nheader_up X-Token {secret.missing}"},
+			IP:     "172.17.0.3",
+		},
+		source.Record{
+			Name:   "invalid",
+			Labels: map[string]string{"virtual.bind": "80 invalid.example.com\nheader_up X-Token {secret.missing}\nsnippet nope"},
+			IP:     "172.17.0.4",
+		},
+	)
+	generator := NewGenerator(src, &config.Config{Network: "gateway", SecretsDir: dir})
+
+	// Site configs keep the reference only
+	records, _ := src.Records()
+	configs := generator.processSiteConfigs(records)
+	if len(configs) != 1 || strings.Contains(configs[0].ProxyDirectives[0], "s3cr3t") {
+		t.Fatalf("configs = %+v; want 1 config without secret value", configs)
+	}
+
+	output, err := generator.GenerateConfig()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if !strings.Contains(output, `header_up Authorization "Bearer s3cr3t"`) || strings.Contains(output, "broken.example.com") || strings.Contains(output, "invalid.example.com") {
+		t.Errorf("GenerateConfig() = %s; want resolved secret and no broken or invalid site", output)
+	}
+}
+
+func TestContainerEnv(t *testing.T) {
+	generator := NewGenerator(source.NewMemory(), &config.Config{Network: "gateway"})
+	record := source.Record{
+		Name: "web",
+		Labels: map[string]string{
+			"virtual.bind": "${PORT} ${HOST}\nheader_up X-Env ${APP_ENV:-production}",
+		},
+		IP:  "172.17.0.2",
+		Env: map[string]string{"PORT": "3000", "HOST": "web.example.com"},
+	}
+
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(configs) != 1 || configs[0].Port != 3000 || configs[0].Hostnames[0] != "web.example.com" {
+		t.Errorf("configs = %+v; want Port=3000, Hostnames=[web.example.com]", configs)
+	}
+	if configs[0].ProxyDirectives[0] != "header_up X-Env production" {
+		t.Errorf("ProxyDirectives = %v; want default value", configs[0].ProxyDirectives)
+	}
+
+	// Test empty variables, only a default replaces them
+	record.Labels["virtual.bind"] = "${PORT} ${HOST}\nheader_up X-Env ${APP_ENV:-production}\nheader_up X-Suffix \"${SUFFIX}\""
+	record.Env["APP_ENV"] = ""
+	record.Env["SUFFIX"] = ""
+	configs, err = generator.processContainer(record)
+	if err != nil || len(configs) != 1 || strings.Join(configs[0].ProxyDirectives, "; ") != `header_up X-Env production; header_up X-Suffix ""` {
+		t.Errorf("processContainer() = %+v, %v; want default for APP_ENV and empty SUFFIX", configs, err)
+	}
+
+	// Test missing variable
+	delete(record.Env, "HOST")
+	configs, err = generator.processContainer(record)
+	if err == nil || err.Error() != "environment variable HOST is not set" || len(configs) != 0 {
+		t.Errorf("processContainer() = %+v, %v; want missing HOST error", configs, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	cfg := &config.Config{
+		Network: "gateway",
+		Mode:    config.ModeSite,
+		Policy: parsePolicy(t, `{
+			"host": {"deny": ["import", "root", "file_server", "tls"]},
+			"proxy": {"allow": ["header_up", "header_down", "transport"]},
+			"projects": {"infra": {"sockets": ["/run/sockets/"]}}
+		}`),
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	record := source.Record{
+		Name:   "web",
+		Labels: map[string]string{},
+		IP:     "172.17.0.2",
+	}
+
+	tests := []struct {
+		bind    string
+		tls     string
+		project string
+		err     string
+	}{
+		{bind: "80 example.com\nheader_up X-Test 1\nhost:encode gzip"},
+		{bind: "80 example.com\nhost:import evil", err: "directive import is not allowed in host scope by policy"},
+		{bind: "80 example.com\nhost:handle {\n  root * /\n  file_server\n}", err: "directive root is not allowed in host scope by policy"},
+		{bind: "80 example.com\nlb_policy first", err: "directive lb_policy is not allowed in proxy scope by policy"},
+		{bind: "80 example.com\nhost:\"root\" * /", err: "directive root is not allowed in host scope by policy"},
+		{bind: "80 example.com\nhost:`file_server` browse", err: "directive file_server is not allowed in host scope by policy"},
+		{bind: "80 example.com\n\"lb_policy\" first", err: "directive lb_policy is not allowed in proxy scope by policy"},
+		{bind: "80 example.com", tls: "internal", project: "shop", err: "directive tls is not allowed in host scope by policy for project shop"},
+		{bind: "80 example.com\nhost:import infra\nlb_policy first", tls: "internal", project: "infra"},
+		{bind: "unix:/var/run/docker.sock example.com", err: "socket /var/run/docker.sock is not allowed for web by policy"},
+		{bind: "unix:/run/sockets/../../var/run/docker.sock example.com", project: "infra", err: "socket /run/sockets/../../var/run/docker.sock is not allowed for web by policy for project infra"},
+		{bind: "unix:/run/sockets/{env.SOCKET} example.com", project: "infra", err: "socket /run/sockets/{env.SOCKET} is not allowed for web by policy for project infra"},
+		{bind: "unix:/run/sockets/app.sock example.com", project: "infra"},
+	}
+	for _, test := range tests {
+		record.Labels["virtual.bind"] = test.bind
+		record.Labels["virtual.tls"] = test.tls
+		record.Labels["com.docker.compose.project"] = test.project
+		configs, err := generator.processContainer(record)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		err = generator.checkPolicy(record, configs)
+		if test.err == "" && err != nil {
+			t.Errorf("checkPolicy(%q) = %v; want no error", test.bind, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("checkPolicy(%q) = %v; want %s", test.bind, err, test.err)
+		}
+	}
+
+	// Violating records are rejected as a whole
+	record.Labels["virtual.bind"] = "80 example.com\n8080 /api example.com\nhost:import evil"
+	record.Labels["com.docker.compose.project"] = ""
+	record.Labels["virtual.tls"] = ""
+	if configs := generator.processSiteConfigs([]source.Record{record}); len(configs) != 0 {
+		t.Errorf("processSiteConfigs() = %+v; want no config", configs)
+	}
+
+	// Closing brackets cannot end the enclosing block, opening ones are counted before comments
+	for _, bind := range []string{
+		"80 a.example.com\n}\nhost:import /etc/evil",
+		"80 a.example.com\nhost:}\nimport /etc/evil",
+		"80 a.example.com\nreverse_proxy { # comment\n  import /etc/evil",
+		"80 a.example.com\n}\nimport /etc/evil\nreverse_proxy { #",
+	} {
+		record.Labels["virtual.bind"] = bind
+		if configs, err := generator.processContainer(record); err == nil {
+			t.Errorf("processContainer(%q) = %+v; want bracket error", bind, configs)
+		}
+	}
+	record.Labels["virtual.bind"] = "80 a.example.com\nhost:handle /x { # comment\n  import /etc/evil\n} # end"
+	configs, err := generator.processContainer(record)
+	if err != nil || len(configs) != 1 || len(configs[0].HostDirectives) != 1 {
+		t.Fatalf("processContainer() = %+v, %v; want 1 host directive", configs, err)
+	}
+	if err := generator.checkPolicy(record, configs); err == nil {
+		t.Errorf("checkPolicy() = nil; want nested import denied")
+	}
+
+	// Records with a parse error after a denied directive are rejected as well
+	record.Labels["virtual.bind"] = "80 victim.example.com\nhost:import /etc/evil\nsnippet nope"
+	if configs := generator.processSiteConfigs([]source.Record{record}); len(configs) != 0 {
+		t.Errorf("processSiteConfigs() = %+v; want no config", configs)
+	}
+}
+
+func TestSecretPolicy(t *testing.T) {
+	cfg := &config.Config{
+		Network: "gateway",
+		Policy: parsePolicy(t, `{
+			"secrets": [
+				{"secrets": ["billing-*"], "projects": ["billing"]},
+				{"secrets": ["shared-*"], "labels": ["team"]}
+			],
+			"projects": {"infra": {}}
+		}`),
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+
+	tests := []struct {
+		bind   string
+		labels map[string]string
+		err    string
+	}{
+		{bind: "80 example.com\nheader_up X-Token {secret.billing-token}", labels: map[string]string{"com.docker.compose.project": "billing"}},
+		{bind: "80 example.com\nheader_up X-Token {secret.billing-token}", labels: map[string]string{"com.docker.compose.project": "shop"}, err: "secret billing-token is not allowed for web by policy for project shop"},
+		{bind: "respond:200 example.com\nbody {secret.admin-token}", labels: map[string]string{}, err: "secret admin-token is not allowed for web by policy"},
+		{bind: "redir:https://example.org/{secret.shared-key} example.com", labels: map[string]string{"team": "ops"}},
+		{bind: "80 example.com\nhost:header X-Token {secret.admin-token}", labels: map[string]string{"com.docker.compose.project": "infra"}},
+	}
+	for _, test := range tests {
+		test.labels["virtual.bind"] = test.bind
+		record := source.Record{Name: "web", Labels: test.labels, IP: "172.17.0.2"}
+		configs, err := generator.processContainer(record)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		err = generator.checkPolicy(record, configs)
+		if test.err == "" && err != nil {
+			t.Errorf("checkPolicy(%q) = %v; want no error", test.bind, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("checkPolicy(%q) = %v; want %s", test.bind, err, test.err)
+		}
+	}
+}
+
+func parsePolicy(t *testing.T, raw string) *config.PolicyConfig {
+	t.Helper()
+	policy, err := config.ParsePolicyConfig(raw)
+	if err != nil {
+		t.Fatalf("ParsePolicyConfig() error: %s", err)
+	}
+	return policy
+}
+
+func parseOwnership(t *testing.T, raw string) []config.OwnershipRule {
+	t.Helper()
+	rules, err := config.ParseOwnership(raw)
+	if err != nil {
+		t.Fatalf("ParseOwnership() error: %s", err)
+	}
+	return rules
+}
+
+func TestOwnership(t *testing.T) {
+	cfg := &config.Config{
+		Network: "gateway",
+		Ownership: parseOwnership(t, `[
+			{"hosts": ["billing.example.com", "*.billing.example.com"], "projects": ["billing"]},
+			{"hosts": ["admin.example.com"], "labels": ["team=ops"], "names": ["^ops-"]}
+		]`),
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	bind := "80 billing.example.com\n8080 api.billing.example.com\n8081 admin.example.com\n8082 shop.example.com"
+
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		hostnames []string
+	}{
+		{"billing-web", map[string]string{"com.docker.compose.project": "billing"}, []string{"billing.example.com", "api.billing.example.com", "shop.example.com"}},
+		{"shop-web", map[string]string{"com.docker.compose.project": "shop"}, []string{"shop.example.com"}},
+		{"shop-ops", map[string]string{"team": "ops"}, []string{"admin.example.com", "shop.example.com"}},
+		{"ops-tool", map[string]string{}, []string{"admin.example.com", "shop.example.com"}},
+	}
+	for _, test := range tests {
+		test.labels["virtual.bind"] = bind
+		record := source.Record{Name: test.name, Labels: test.labels, IP: "172.17.0.2"}
+		var hostnames []string
+		for _, item := range generator.processSiteConfigs([]source.Record{record}) {
+			hostnames = append(hostnames, item.Hostnames...)
+		}
+		if strings.Join(hostnames, " ") != strings.Join(test.hostnames, " ") {
+			t.Errorf("hostnames of %s = %v; want %v", test.name, hostnames, test.hostnames)
+		}
+	}
+
+	// Hostnames are normalized before matching, those that cannot be normalized are dropped
+	record := source.Record{
+		Name:   "shop-web",
+		Labels: map[string]string{"com.docker.compose.project": "shop"},
+		IP:     "172.17.0.2",
+	}
+	for _, hostname := range []string{"pay.billing.example.com:443", "pay.billing.example.com.", "https://Pay.Billing.example.com", "pay.billing.example.com/x", "{$HOST}"} {
+		record.Labels["virtual.bind"] = "80 " + hostname
+		if configs := generator.processSiteConfigs([]source.Record{record}); len(configs) != 0 {
+			t.Errorf("processSiteConfigs(%s) = %+v; want no config", hostname, configs)
+		}
+	}
+	record.Labels["virtual.bind"] = "80 shop.example.com:443"
+	if configs := generator.processSiteConfigs([]source.Record{record}); len(configs) != 1 {
+		t.Errorf("processSiteConfigs() = %+v; want shop.example.com:443", configs)
+	}
+
+	// Wildcards are dropped when they match a single label of a hostname owned by others
+	for _, hostname := range []string{"*.example.com", "*.*.example.com", "*.billing.example.com", "*"} {
+		record.Labels["virtual.bind"] = "80 " + hostname
+		if configs := generator.processSiteConfigs([]source.Record{record}); len(configs) != 0 {
+			t.Errorf("processSiteConfigs(%s) = %+v; want no config", hostname, configs)
+		}
+	}
+	for _, hostname := range []string{"*.shop.example.com", "*.example.org"} {
+		record.Labels["virtual.bind"] = "80 " + hostname
+		if configs := generator.processSiteConfigs([]source.Record{record}); len(configs) != 1 {
+			t.Errorf("processSiteConfigs(%s) = %+v; want one config", hostname, configs)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "users"), []byte("# admins\nalice $2a$14$hash\n"), 0600)
+	cfg := &config.Config{
+		Network:    "gateway",
+		SecretsDir: dir,
+		AuthProviders: config.ParseAuthProviders(`{
+			"sso": {"type": "forward_auth", "url": "authelia:9091", "uri": "/api/verify", "copyHeaders": ["Remote-User", "Remote-Groups"]},
+			"admins": {"type": "basic_auth", "usersFile": "users"}
+		}`),
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+
+	tests := []struct {
+		auth     string
+		expected []string
+		err      string
+	}{
+		{
+			auth: "sso",
+			expected: []string{
+				"  forward_auth /admin authelia:9091 {",
+				"    uri /api/verify",
+				"    copy_headers Remote-User Remote-Groups",
+				"  }",
+			},
+		},
+		{
+			auth:     "admins",
+			expected: []string{"  basic_auth /admin {", "    alice $2a$14$hash", "  }"},
+		},
+		{auth: "unknown", err: "unknown auth provider: unknown"},
+	}
+	for _, test := range tests {
+		record := source.Record{
+			Name:   "web",
+			Labels: map[string]string{"virtual.bind": "80 /admin example.com", "virtual.auth": test.auth},
+			IP:     "172.17.0.2",
+		}
+		configs, err := generator.processContainer(record)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("processContainer(%s) = %v; want %s", test.auth, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		lines := generator.generateDirectives(configs, "proxy")
+		expected := slices.Concat([]string{"  # web"}, test.expected, []string{"  reverse_proxy /admin {"})
+		if !slices.Equal(lines[:len(expected)], expected) {
+			t.Errorf("generateDirectives(%s) = %q; want prefix %q", test.auth, lines, expected)
+		}
+	}
+
+	// Routes fail closed when the users file disappears
+	configs, _ := generator.processContainer(source.Record{
+		Name:   "web",
+		Labels: map[string]string{"virtual.bind": "80 example.com", "virtual.auth": "admins"},
+		IP:     "172.17.0.2",
+	})
+	os.Remove(filepath.Join(dir, "users"))
+	lines := generator.generateDirectives(configs, "proxy")
+	if lines[1] != `  error  "Authentication unavailable" 503` {
+		t.Errorf("generateDirectives() = %q; want error directive", lines)
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	cfg := &config.Config{
+		Network: "gateway",
+		Snippets: config.ParseSnippets(`{
+			"security": ["header {\n  Strict-Transport-Security max-age=31536000\n  X-Content-Type-Options nosniff\n}", "encode gzip zstd"],
+			"cors": ["header_down Access-Control-Allow-Origin {args[0]}", "header_down Access-Control-Allow-Methods {args[1]}"]
+		}`),
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	record := source.Record{
+		Name:   "web",
+		Labels: map[string]string{"virtual.bind": "80 example.com\nhost:snippet security\nsnippet cors https://app.example.com GET,POST"},
+		IP:     "172.17.0.2",
+	}
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	expected := `example.com {
+  header {
+  Strict-Transport-Security max-age=31536000
+  X-Content-Type-Options nosniff
+}
+  encode gzip zstd
+  # web
+  reverse_proxy  {
+    header_down Access-Control-Allow-Origin https://app.example.com
+    header_down Access-Control-Allow-Methods GET,POST
+    to 172.17.0.2:80
+  }
+}`
+	cfg.Mode = config.ModeSite
+	if output := generator.generateCaddyConfig(generator.groupSiteConfigs(configs)); output != expected {
+		t.Errorf("generateCaddyConfig() = %s; want %s", output, expected)
+	}
+
+	tests := []struct {
+		bind string
+		err  string
+	}{
+		{bind: "80 example.com\nsnippet unknown", err: "unknown snippet: unknown"},
+		{bind: "80 example.com\nhost:snippet", err: "missing snippet name"},
+		{bind: "80 example.com\nsnippet cors https://app.example.com", err: "snippet cors needs argument 1"},
+	}
+	for _, test := range tests {
+		record.Labels["virtual.bind"] = test.bind
+		configs, err := generator.processContainer(record)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("processContainer(%q) = %v; want %s", test.bind, err, test.err)
+		}
+		if len(configs) != 1 || len(configs[0].HostDirectives)+len(configs[0].ProxyDirectives) != 0 {
+			t.Errorf("processContainer(%q) = %+v; want config without the invalid directive", test.bind, configs)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	cfg := &config.Config{Network: "gateway", Mode: config.ModeSite}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	record := source.Record{
+		Name: "web",
+		Labels: map[string]string{
+			"virtual.bind": strings.Join([]string{
+				"80 example.com canonical=www",
+				"redir:https://docs.example.com{uri} /docs* www.example.com code=301",
+				"respond:503 status.example.com",
+				"body \"Down for maintenance\"",
+				"close",
+			}, "\n"),
+		},
+		IP: "172.17.0.2",
+	}
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	expected := `example.com {
+  # web
+  redir  {scheme}://www.example.com{uri} permanent
+}
+
+status.example.com {
+  # web
+  respond  503 {
+    body "Down for maintenance"
+    close
+  }
+}
+
+www.example.com {
+  # web
+  reverse_proxy  {
+    to 172.17.0.2:80
+  }
+  # web
+  redir /docs* https://docs.example.com{uri} 301
+}`
+	if output := generator.generateCaddyConfig(generator.groupSiteConfigs(configs)); output != expected {
+		t.Errorf("generateCaddyConfig() = %s; want %s", output, expected)
+	}
+
+	tests := []struct {
+		bind string
+		err  string
+	}{
+		{bind: "redir: example.com", err: "missing redirect target"},
+		{bind: "respond:ok example.com", err: "invalid status: ok"},
+		{bind: "80 example.com code=301", err: "invalid redirect code: 301"},
+		{bind: "redir:https://example.com www.example.com code=200", err: "invalid redirect code: 200"},
+		{bind: "80 example.com canonical=yes", err: "invalid canonical hostname: yes, want www or apex"},
+		{bind: "80 *.example.com canonical=apex", err: "wildcard hostname cannot be canonicalized: *.example.com"},
+		{bind: "80 example.com foo=bar", err: "unknown bind option: foo"},
+		{bind: "redir:https://example.com www.example.com\nheader_up Host example.com", err: "redir routes take no proxy directives: header_up Host example.com"},
+	}
+	for _, test := range tests {
+		record.Labels["virtual.bind"] = test.bind
+		_, err := generator.processContainer(record)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("processContainer(%q) = %v; want %s", test.bind, err, test.err)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	src := source.NewMemory(
+		source.Record{
+			Name:   "web",
+			Labels: map[string]string{"virtual.bind": "80 example.com\n8080 /api example.com"},
+			State:  "exited",
+		},
+		source.Record{
+			Name:   "api",
+			Labels: map[string]string{"virtual.bind": "8080 /api example.com"},
+			IP:     "172.17.0.3",
+			State:  "running",
+		},
+	)
+	cfg := &config.Config{Network: "gateway", Mode: config.ModeSite}
+	generator := NewGenerator(src, cfg)
+
+	// Stopped containers are removed without maintenance
+	output, err := generator.GenerateConfig()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if strings.Contains(output, "# web") {
+		t.Errorf("GenerateConfig() = %s; want no route of web", output)
+	}
+
+	cfg.Maintenance = config.ParseMaintenanceConfig(`{"body": "Back \"soon\""}`)
+	output, err = generator.GenerateConfig()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	expected := `example.com {
+  # web
+  respond  "Back \"soon\"" 503
+  # api
+  reverse_proxy /api {
+    to 172.17.0.3:8080
+  }
+  handle_errors 502 503 504 {
+    respond "Back \"soon\"" {err.status_code}
+  }
+}`
+	if output != expected {
+		t.Errorf("GenerateConfig() = %s; want %s", output, expected)
+	}
+
+	cfg.Maintenance = config.ParseMaintenanceConfig(`{"status": 502, "root": "/srv/errors"}`)
+	output, _ = generator.GenerateConfig()
+	for _, line := range []string{"  handle  {", "    rewrite * /502.html", "      status 502", "    rewrite * /{err.status_code}.html"} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("GenerateConfig() = %s; want line %q", output, line)
+		}
+	}
+}
+
+func TestWakeRoutes(t *testing.T) {
+	src := source.NewMemory(
+		source.Record{
+			Name:   "tool",
+			Origin: "local",
+			Labels: map[string]string{"virtual.bind": "80 tool.example.com", "virtual.wake": "true"},
+			State:  "exited",
+		},
+		source.Record{
+			Name:   "legacy",
+			Origin: "local",
+			Labels: map[string]string{"virtual.bind": "80 legacy.example.com"},
+			State:  "exited",
+		},
+	)
+	cfg := &config.Config{
+		Network: "gateway",
+		Mode:    config.ModeSite,
+		Waker:   config.ParseWakerConfig(`{"upstream": "caddy-gen:8090", "token": "secret"}`),
+	}
+	output, err := NewGenerator(src, cfg).GenerateConfig()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	expected := `tool.example.com {
+  # tool
+  reverse_proxy  {
+    header_up X-Caddy-Gen-Name "tool"
+    header_up X-Caddy-Gen-Origin "local"
+    header_up X-Caddy-Gen-Token "secret"
+    to caddy-gen:8090
+  }
+}`
+	if output != expected {
+		t.Errorf("GenerateConfig() = %s; want %s", output, expected)
+	}
+}
+
+func TestUpstreamSchemes(t *testing.T) {
+	cfg := &config.Config{Network: "gateway"}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	record := source.Record{
+		Name: "web",
+		Labels: map[string]string{
+			"virtual.bind": strings.Join([]string{
+				"https:8443 /admin example.com tls_insecure_skip_verify=true tls_server_name=web.internal dial_timeout=5s",
+				"h2c:50051 /grpc example.com",
+				"unix:/run/app/app.sock example.com",
+			}, "\n"),
+		},
+		IP: "172.17.0.2",
+	}
+	configs, err := generator.processContainer(record)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	expected := []string{
+		"  # web",
+		"  reverse_proxy /admin {",
+		"    transport http {",
+		"      dial_timeout 5s",
+		"      tls_insecure_skip_verify",
+		"      tls_server_name web.internal",
+		"    }",
+		"    to https://172.17.0.2:8443",
+		"  }",
+		"  # web",
+		"  reverse_proxy /grpc {",
+		"    to h2c://172.17.0.2:50051",
+		"  }",
+		"  # web",
+		"  reverse_proxy  {",
+		"    to unix//run/app/app.sock",
+		"  }",
+	}
+	if lines := generator.generateDirectives(configs, "proxy"); !slices.Equal(lines, expected) {
+		t.Errorf("generateDirectives() = %q; want %q", lines, expected)
+	}
+
+	tests := []struct {
+		bind string
+		err  string
+	}{
+		{bind: "unix:run/app.sock example.com", err: "invalid socket path: run/app.sock"},
+		{bind: "https:0 example.com", err: "invalid port: 0"},
+		{bind: "https:h2c:80 example.com", err: "invalid port: h2c:80"},
+		{bind: "80 example.com tls_server_name=web.internal", err: "transport option tls_server_name requires an https upstream"},
+		{bind: "https:443 example.com tls_insecure_skip_verify=maybe", err: "invalid value of tls_insecure_skip_verify: maybe"},
+		{bind: "80 example.com dial_timeout=soon", err: "invalid value of dial_timeout: soon"},
+		{bind: "respond:200 example.com read_timeout=5s", err: "transport option read_timeout requires an upstream"},
+	}
+	for _, test := range tests {
+		record.Labels["virtual.bind"] = test.bind
+		_, err := generator.processContainer(record)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("processContainer(%q) = %v; want %s", test.bind, err, test.err)
+		}
+	}
+}
+
+func TestL4(t *testing.T) {
+	cfg := &config.Config{Network: "gateway", DefaultDomain: "example.com"}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	records := []source.Record{
+		{
+			Name: "db",
+			Labels: map[string]string{
+				"virtual.l4":                 "443 tls:{service}.{domain} 5432\nudp/1883 1883",
+				"com.docker.compose.service": "db",
+			},
+			IP: "172.17.0.2",
+		},
+		{Name: "git", Labels: map[string]string{"virtual.l4": "443 ssh 22\n2222 22"}, IP: "172.17.0.3"},
+		{Name: "fallback", Labels: map[string]string{"virtual.l4": "443 8443"}, IP: "172.17.0.4"},
+		{Name: "other", Labels: map[string]string{"virtual.l4": "443 9443"}, IP: "172.17.0.5"},
+		{Name: "stopped", Labels: map[string]string{"virtual.l4": "3306 3306"}, State: "exited"},
+	}
+	expected := `layer4 {
+  :2222 {
+    route {
+      # git
+      proxy 172.17.0.3:22
+    }
+  }
+  :443 {
+    @caddy-gen-l4-0 tls sni db.example.com
+    route @caddy-gen-l4-0 {
+      # db
+      proxy 172.17.0.2:5432
+    }
+    @caddy-gen-l4-1 ssh
+    route @caddy-gen-l4-1 {
+      # git
+      proxy 172.17.0.3:22
+    }
+    route {
+      # fallback
+      proxy 172.17.0.4:8443
+    }
+  }
+  udp/:1883 {
+    route {
+      # db
+      proxy udp/172.17.0.2:1883
+    }
+  }
+}`
+	if output := generator.generateL4Config(generator.processL4Configs(records)); output != expected {
+		t.Errorf("generateL4Config() = %s; want %s", output, expected)
+	}
+
+	tests := []struct {
+		bind string
+		err  string
+	}{
+		{bind: "5432", err: "invalid L4 binding: 5432"},
+		{bind: "sctp/5432 5432", err: "invalid protocol: sctp"},
+		{bind: "5432 70000", err: "invalid port: 70000"},
+		{bind: "443 smtp 25", err: "unknown L4 matcher: smtp"},
+		{bind: "443 ssh:git.example.com 22", err: "unknown L4 matcher: ssh:git.example.com"},
+	}
+	for _, test := range tests {
+		record := source.Record{Name: "db", Labels: map[string]string{"virtual.l4": test.bind}, IP: "172.17.0.2"}
+		if _, err := generator.parseL4Bind(record, test.bind); err == nil || err.Error() != test.err {
+			t.Errorf("parseL4Bind(%q) = %v; want %s", test.bind, err, test.err)
+		}
+	}
+
+	// Remote endpoints are reached through the published port of the protocol
+	record := source.Record{
+		Name:        "mqtt",
+		HostAddress: "10.0.0.2",
+		Ports:       []source.Port{{Private: 1883, Public: 1883, Protocol: "tcp"}, {Private: 1883, Public: 11883, Protocol: "udp"}},
+	}
+	if configs, err := generator.parseL4Bind(record, "udp/1883 1883"); err != nil || !slices.Equal(configs[0].Upstreams, []string{"udp/10.0.0.2:11883"}) {
+		t.Errorf("parseL4Bind() = %+v, %v; want upstream udp/10.0.0.2:11883", configs, err)
+	}
+
+	// Matcher hostnames are subject to the ownership rules
+	cfg.Ownership = parseOwnership(t, `[{"hosts": ["*.billing.example.com"], "projects": ["billing"]}]`)
+	generator = NewGenerator(source.NewMemory(), cfg)
+	records = []source.Record{
+		{Name: "shop", Labels: map[string]string{"virtual.l4": "443 tls:pay.billing.example.com 443\n2222 22"}, IP: "172.17.0.2"},
+		{Name: "pay", Labels: map[string]string{"virtual.l4": "443 tls:pay.billing.example.com 443", "com.docker.compose.project": "billing"}, IP: "172.17.0.3"},
+	}
+	var names []string
+	for _, item := range generator.processL4Configs(records) {
+		names = append(names, item.Name+" "+item.Listen)
+	}
+	if strings.Join(names, ", ") != "shop :2222, pay :443" {
+		t.Errorf("processL4Configs() = %v; want the SNI route of shop dropped", names)
+	}
+
+	// Records with an invalid binding are dropped as a whole
+	records = []source.Record{{Name: "db", Labels: map[string]string{"virtual.l4": "5432 5432\nbogus"}, IP: "172.17.0.2"}}
+	if configs := generator.processL4Configs(records); len(configs) != 0 {
+		t.Errorf("processL4Configs() = %+v; want no config", configs)
+	}
+}
+
+func TestResolveUpstream(t *testing.T) {
+	generator := NewGenerator(source.NewMemory(), &config.Config{Network: "gateway"})
+	ports := []source.Port{{Private: 80, Public: 8081, Protocol: "tcp"}}
+	tests := []struct {
+		record  source.Record
+		address string
+		err     string
+	}{
+		{record: source.Record{Name: "web", IP: "172.17.0.2"}, address: "172.17.0.2:80"},
+		{record: source.Record{Name: "host", HostAddress: "172.17.0.1", HostNetwork: true}, address: "172.17.0.1:80"},
+		{record: source.Record{Name: "bridge", HostAddress: "172.17.0.1", Ports: ports}, address: "172.17.0.1:8081"},
+		{record: source.Record{Name: "private", Origin: "local", HostAddress: "172.17.0.1"}, err: "port 80/tcp of private on local is not published"},
+		{record: source.Record{Name: "lost"}, err: "lost is not reachable, it has no address on the network and the host address is unknown"},
+	}
+	for _, test := range tests {
+		ips, port, err := generator.resolveUpstream(test.record, 80, "tcp")
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("resolveUpstream(%s) = %v; want %s", test.record.Name, err, test.err)
+			}
+		} else if address := strings.Join(joinHostPort(ips, port), " "); err != nil || address != test.address {
+			t.Errorf("resolveUpstream(%s) = %s, %v; want %s", test.record.Name, address, err, test.address)
+		}
+	}
+}
+
+func TestIPPreference(t *testing.T) {
+	cfg := &config.Config{Network: "gateway"}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	dualStack := source.Record{Name: "web", IP: "172.17.0.2", IPv6: "fd00::2"}
+	ipv6Only := source.Record{Name: "web", IPv6: "fd00::3"}
+	tests := []struct {
+		preference string
+		record     source.Record
+		addresses  string
+	}{
+		{preference: config.IPv4, record: dualStack, addresses: "172.17.0.2:80"},
+		{preference: config.IPv4, record: ipv6Only, addresses: "[fd00::3]:80"},
+		{preference: config.IPv6, record: dualStack, addresses: "[fd00::2]:80"},
+		{preference: config.Dual, record: dualStack, addresses: "172.17.0.2:80 [fd00::2]:80"},
+		{preference: config.Dual, record: ipv6Only, addresses: "[fd00::3]:80"},
+	}
+	for _, test := range tests {
+		cfg.IPPreference = test.preference
+		ips, port, err := generator.resolveUpstream(test.record, 80, "tcp")
+		if addresses := strings.Join(joinHostPort(ips, port), " "); err != nil || addresses != test.addresses {
+			t.Errorf("resolveUpstream(%s, %+v) = %s, %v; want %s", test.preference, test.record, addresses, err, test.addresses)
+		}
+	}
+
+	// Dual-stack upstreams are load balanced in reverse_proxy and L4 routes
+	cfg.IPPreference = config.Dual
+	dualStack.Labels = map[string]string{"virtual.bind": "https:443 example.com", "virtual.l4": "udp/53 53"}
+	configs, _ := generator.processContainer(dualStack)
+	if lines := generator.generateDirectives(configs, "proxy"); lines[2] != "    to https://172.17.0.2:443 https://[fd00::2]:443" {
+		t.Errorf("generateDirectives() = %q; want both upstreams", lines)
+	}
+	l4Configs, _ := generator.parseL4Bind(dualStack, dualStack.Labels["virtual.l4"])
+	if output := generator.generateL4Config(l4Configs); !strings.Contains(output, "proxy udp/172.17.0.2:53 udp/[fd00::2]:53\n") {
+		t.Errorf("generateL4Config() = %s; want both upstreams", output)
+	}
+}
+
+func TestAutoPort(t *testing.T) {
+	cfg := &config.Config{
+		Network:    "gateway",
+		ImagePorts: config.ParseImagePorts(`{"grafana/grafana": 3000, "registry.example.com:5000/app": 8000}`),
+	}
+	generator := NewGenerator(source.NewMemory(), cfg)
+	tests := []struct {
+		bind  string
+		image string
+		ports []source.Port
+		port  int
+		err   string
+	}{
+		{bind: "auto example.com", ports: []source.Port{{Private: 8080, Protocol: "tcp"}, {Private: 53, Protocol: "udp"}}, port: 8080},
+		{bind: "https:auto example.com", ports: []source.Port{{Private: 8443, Public: 443, Protocol: "tcp"}}, port: 8443},
+		{bind: "auto example.com", image: "grafana/grafana:10.4.0", ports: []source.Port{{Private: 3000, Protocol: "tcp"}, {Private: 9090, Protocol: "tcp"}}, port: 3000},
+		{bind: "auto example.com", image: "registry.example.com:5000/app@sha256:abc", port: 8000},
+		{bind: "auto example.com", ports: []source.Port{{Private: 80, Protocol: "tcp"}, {Private: 443, Protocol: "tcp"}}, err: "cannot infer port of web: ambiguous ports 80, 443"},
+		{bind: "auto example.com", image: "nginx", err: "cannot infer port of web: no exposed TCP port"},
+	}
+	for _, test := range tests {
+		record := source.Record{
+			Name:   "web",
+			Image:  test.image,
+			Labels: map[string]string{"virtual.bind": test.bind},
+			IP:     "172.17.0.2",
+			Ports:  test.ports,
+		}
+		configs, err := generator.processContainer(record)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("processContainer(%q) = %v; want %s", test.bind, err, test.err)
+			}
+			continue
+		}
+		if err != nil || len(configs) != 1 || configs[0].Port != test.port {
+			t.Errorf("processContainer(%q) = %+v, %v; want port %d", test.bind, configs, err, test.port)
+		}
+	}
+
+	// Ambiguous ports of a bind are reported as a config error rather than skipped by auto-exposure
+	record := source.Record{
+		Name:   "web",
+		Labels: map[string]string{"virtual.bind": "auto example.com"},
+		Ports:  []source.Port{{Private: 80, Protocol: "tcp"}, {Private: 443, Protocol: "tcp"}},
+	}
+	var ambiguous *ambiguousPortsError
+	if _, err := generator.processRecord(record); errors.As(err, &ambiguous) {
+		t.Errorf("processRecord() = %v; want a config error", err)
+	}
+}
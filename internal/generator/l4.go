@@ -0,0 +1,184 @@
+package generator
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// L4Config is a TCP or UDP route of the layer4 app
+type L4Config struct {
+	Name      string
+	Listen    string   // Listener address, e.g. :5432 or udp/:1883
+	Matcher   string   // Matcher of the connection, e.g. tls sni db.example.com, empty to match all
+	Hostnames []string // Hostnames of the matcher, checked against the ownership rules
+	Upstreams []string // Upstream addresses, e.g. 172.17.0.2:5432 or udp/172.17.0.2:1883
+}
+
+// l4Protocols are the protocols that can be matched without arguments
+var l4Protocols = []string{"http", "openvpn", "postgres", "quic", "rdp", "socks4", "socks5", "ssh", "tls", "xmpp"}
+
+// l4ArgMatchers are the matchers that take hostnames, e.g. tls:db.example.com
+var l4ArgMatchers = map[string]string{
+	"tls":  "tls sni",
+	"http": "http host",
+}
+
+func (g *Generator) processL4Configs(records []source.Record) []L4Config {
+	var l4Configs []L4Config
+	for _, record := range records {
+		raw, exists := record.Labels["virtual.l4"]
+		if !exists || strings.TrimSpace(raw) == "" || !record.Running() {
+			continue
+		}
+		configs, err := g.parseL4Bind(record, raw)
+		if err != nil {
+			// Bindings parsed before an error are dropped with the record, like its site configs
+			log.Printf("L4 config error in %s: %s", record.Name, err)
+			continue
+		}
+		for _, item := range configs {
+			if err := g.checkHostnames(record, item.Hostnames); err != nil {
+				log.Printf("Dropped L4 bind of %s: %s", record.Name, err)
+				continue
+			}
+			l4Configs = append(l4Configs, item)
+		}
+	}
+	return l4Configs
+}
+
+// parseL4Bind parses the virtual.l4 label, one [PROTOCOL/]LISTEN [MATCHER] PORT binding per line
+func (g *Generator) parseL4Bind(record source.Record, raw string) ([]L4Config, error) {
+	var configs []L4Config
+	var vars map[string]string
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 2 || len(parts) > 3 {
+			return configs, fmt.Errorf("invalid L4 binding: %s", line)
+		}
+		protocol, listen, found := strings.Cut(parts[0], "/")
+		if !found {
+			protocol, listen = "tcp", parts[0]
+		}
+		if protocol != "tcp" && protocol != "udp" {
+			return configs, fmt.Errorf("invalid protocol: %s", protocol)
+		}
+		if err := checkPort(listen); err != nil {
+			return configs, err
+		}
+		config := L4Config{Name: record.Name, Listen: ":" + listen}
+		if len(parts) == 3 {
+			if vars == nil {
+				vars = g.templateVars(record)
+			}
+			matcher, hosts, err := g.parseL4Matcher(parts[1], vars)
+			if err != nil {
+				return configs, err
+			}
+			config.Matcher = matcher
+			config.Hostnames = hosts
+		}
+		if err := checkPort(parts[len(parts)-1]); err != nil {
+			return configs, err
+		}
+		port, _ := strconv.Atoi(parts[len(parts)-1])
+		ips, port, err := g.resolveUpstream(record, port, protocol)
+		if err != nil {
+			return configs, err
+		}
+		config.Upstreams = joinHostPort(ips, port)
+		if protocol == "udp" {
+			config.Listen = "udp/" + config.Listen
+			for i, upstream := range config.Upstreams {
+				config.Upstreams[i] = "udp/" + upstream
+			}
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// parseL4Matcher parses a PROTOCOL or PROTOCOL:HOST1,HOST2 matcher and returns its hostnames
+func (g *Generator) parseL4Matcher(raw string, vars map[string]string) (string, []string, error) {
+	protocol, rawHosts, hasHosts := strings.Cut(raw, ":")
+	if !hasHosts {
+		if !slices.Contains(l4Protocols, protocol) {
+			return "", nil, fmt.Errorf("unknown L4 matcher: %s", protocol)
+		}
+		return protocol, nil, nil
+	}
+	matcher, exists := l4ArgMatchers[protocol]
+	if !exists || rawHosts == "" {
+		return "", nil, fmt.Errorf("unknown L4 matcher: %s", raw)
+	}
+	hosts, err := g.expandHostnames(strings.Split(rawHosts, ","), vars)
+	if err != nil {
+		return "", nil, err
+	}
+	return matcher + " " + strings.Join(hosts, " "), hosts, nil
+}
+
+func checkPort(raw string) error {
+	port, err := strconv.Atoi(raw)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port: %s", raw)
+	}
+	return nil
+}
+
+// generateL4Config renders the layer4 app with one server per listener address,
+// routes with a matcher come before the route matching all connections
+func (g *Generator) generateL4Config(configs []L4Config) string {
+	servers := make(map[string][]L4Config)
+	for _, item := range configs {
+		servers[item.Listen] = append(servers[item.Listen], item)
+	}
+	if len(servers) == 0 {
+		return ""
+	}
+	listens := make([]string, 0, len(servers))
+	for listen := range servers {
+		listens = append(listens, listen)
+	}
+	sort.Strings(listens)
+
+	lines := []string{"layer4 {"}
+	for _, listen := range listens {
+		routes := servers[listen]
+		sort.SliceStable(routes, func(i, j int) bool {
+			return routes[i].Matcher != "" && routes[j].Matcher == ""
+		})
+		lines = append(lines, fmt.Sprintf("  %s {", listen))
+		catchAll := false
+		for i, item := range routes {
+			route := "route"
+			if item.Matcher != "" {
+				matcher := fmt.Sprintf("@caddy-gen-l4-%d", i)
+				lines = append(lines, fmt.Sprintf("    %s %s", matcher, item.Matcher))
+				route += " " + matcher
+			} else if catchAll {
+				log.Printf("L4 route of %s on %s conflicts with another route matching all connections, ignored", item.Name, listen)
+				continue
+			} else {
+				catchAll = true
+			}
+			lines = append(lines, fmt.Sprintf("    %s {", route))
+			lines = append(lines, fmt.Sprintf("      # %s", item.Name))
+			lines = append(lines, fmt.Sprintf("      proxy %s", strings.Join(item.Upstreams, " ")))
+			lines = append(lines, "    }")
+		}
+		lines = append(lines, "  }")
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
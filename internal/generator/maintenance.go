@@ -0,0 +1,140 @@
+package generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/source"
+	"github.com/gera2ld/caddy-gen/internal/waker"
+)
+
+// Kinds of routes of stopped containers
+const (
+	routeMaintenance = "maintenance"
+	routeWake        = "wake"
+)
+
+// errorStatuses are the upstream failures served with error pages
+var errorStatuses = []string{"502", "503", "504"}
+
+// stoppedRoute returns the kind of routes of a stopped container, empty if it has no route
+func (g *Generator) stoppedRoute(record source.Record) string {
+	if g.config.Waker != nil && waker.Enabled(record) {
+		return routeWake
+	}
+	if g.config.Maintenance != nil {
+		return routeMaintenance
+	}
+	return ""
+}
+
+// toStopped turns the routes of a stopped container into wake up routes or maintenance responses
+func (g *Generator) toStopped(record source.Record, configs []SiteConfig) []SiteConfig {
+	if record.Running() {
+		return configs
+	}
+	route := g.stoppedRoute(record)
+	if route == "" {
+		return nil
+	}
+	for i := range configs {
+		if configs[i].Route != "" {
+			continue
+		}
+		configs[i].Route = route
+		configs[i].Origin = record.Origin
+		if route == routeMaintenance {
+			configs[i].Status = strconv.Itoa(g.config.Maintenance.Status)
+		}
+	}
+	return configs
+}
+
+// dropShadowedStopped drops the routes of stopped containers whose hostname and path are served by a running container
+func dropShadowedStopped(configs []SiteConfig) []SiteConfig {
+	served := make(map[string]bool)
+	for _, item := range configs {
+		if !isStoppedRoute(item.Route) {
+			for _, hostname := range item.Hostnames {
+				served[hostname+" "+item.PathMatcher] = true
+			}
+		}
+	}
+	var result []SiteConfig
+	for _, item := range configs {
+		if isStoppedRoute(item.Route) {
+			var hostnames []string
+			for _, hostname := range item.Hostnames {
+				if !served[hostname+" "+item.PathMatcher] {
+					hostnames = append(hostnames, hostname)
+				}
+			}
+			if len(hostnames) == 0 {
+				continue
+			}
+			item.Hostnames = hostnames
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+func isStoppedRoute(route string) bool {
+	return route == routeMaintenance || route == routeWake
+}
+
+// generateWakeDirectives forwards the requests of a stopped container to the waker
+func (g *Generator) generateWakeDirectives(item SiteConfig) []string {
+	lines := []string{
+		fmt.Sprintf("  reverse_proxy %s {", item.PathMatcher),
+		fmt.Sprintf("    header_up %s %s", waker.NameHeader, quote(item.Name)),
+		fmt.Sprintf("    header_up %s %s", waker.OriginHeader, quote(item.Origin)),
+		fmt.Sprintf("    header_up %s %s", waker.TokenHeader, quote(g.config.Waker.Token)),
+		fmt.Sprintf("    to %s", g.config.Waker.Upstream),
+	}
+	return append(lines, "  }")
+}
+
+// generateMaintenanceDirectives renders the maintenance response of a stopped container
+func (g *Generator) generateMaintenanceDirectives(item SiteConfig) []string {
+	maintenance := g.config.Maintenance
+	if maintenance.Root == "" {
+		return []string{fmt.Sprintf("  respond %s %s %s", item.PathMatcher, quote(maintenance.Body), item.Status)}
+	}
+	return []string{
+		fmt.Sprintf("  handle %s {", item.PathMatcher),
+		fmt.Sprintf("    root * %s", maintenance.Root),
+		fmt.Sprintf("    rewrite * /%s.html", item.Status),
+		"    file_server {",
+		fmt.Sprintf("      status %s", item.Status),
+		"    }",
+		"  }",
+	}
+}
+
+// generateErrorDirectives renders the error pages of upstream failures in a site block
+func (g *Generator) generateErrorDirectives() []string {
+	maintenance := g.config.Maintenance
+	if maintenance == nil {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("  handle_errors %s {", strings.Join(errorStatuses, " "))}
+	if maintenance.Root == "" {
+		lines = append(lines, fmt.Sprintf("    respond %s {err.status_code}", quote(maintenance.Body)))
+	} else {
+		lines = append(lines,
+			fmt.Sprintf("    root * %s", maintenance.Root),
+			"    rewrite * /{err.status_code}.html",
+			"    file_server {",
+			"      status {err.status_code}",
+			"    }",
+		)
+	}
+	return append(lines, "  }")
+}
+
+// quote quotes a Caddyfile token
+func quote(value string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+}
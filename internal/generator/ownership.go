@@ -0,0 +1,214 @@
+package generator
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// ownershipRule is an ownership rule with compiled patterns
+type ownershipRule struct {
+	hosts    []*regexp.Regexp
+	patterns []string // Lower-cased hostname patterns, compared with claimed wildcards
+	owners
+}
+
+// owners matches the containers a rule applies to
+type owners struct {
+	projects []string
+	labels   []string
+	names    []*regexp.Regexp
+}
+
+// compileOwnership compiles the ownership rules, invalid patterns are logged and ignored
+func compileOwnership(rules []config.OwnershipRule) []ownershipRule {
+	var result []ownershipRule
+	for _, rule := range rules {
+		compiled := ownershipRule{owners: compileOwners(rule.Projects, rule.Labels, rule.Names, "ownership rule")}
+		for _, host := range rule.Hosts {
+			compiled.hosts = append(compiled.hosts, compileWildcard(strings.ToLower(host)))
+			compiled.patterns = append(compiled.patterns, strings.ToLower(host))
+		}
+		result = append(result, compiled)
+	}
+	return result
+}
+
+func compileOwners(projects, labels, names []string, kind string) owners {
+	result := owners{projects: projects, labels: labels}
+	for _, name := range names {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			log.Printf("Ignored invalid name pattern %q in %s: %v", name, kind, err)
+			continue
+		}
+		result.names = append(result.names, re)
+	}
+	return result
+}
+
+// compileWildcard compiles a pattern where * matches any characters
+func compileWildcard(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+// claims reports whether the rule covers a hostname, or some of the hosts of a wildcard hostname
+func (r *ownershipRule) claims(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	if strings.Contains(hostname, "*") {
+		return slices.ContainsFunc(r.patterns, func(pattern string) bool { return overlaps(hostname, pattern) })
+	}
+	return slices.ContainsFunc(r.hosts, func(re *regexp.Regexp) bool { return re.MatchString(hostname) })
+}
+
+// overlaps reports whether a wildcard hostname, where * matches one label as in Caddy,
+// matches any host of a rule pattern, where * matches any characters.
+// Both are walked together as automata over the characters they contain, a character of neither and the dot.
+func overlaps(wildcard, pattern string) bool {
+	if wildcard == "*" {
+		// A bare wildcard may serve as a catch-all site
+		return true
+	}
+	alphabet := []byte{'.'}
+	for _, c := range []byte("abcdefghijklmnopqrstuvwxyz0123456789-_") {
+		if !strings.ContainsRune(wildcard+pattern, rune(c)) {
+			alphabet = append(alphabet, c)
+			break
+		}
+	}
+	for _, c := range []byte(wildcard + pattern) {
+		if c != '*' && !slices.Contains(alphabet, c) {
+			alphabet = append(alphabet, c)
+		}
+	}
+
+	// i is the position in the wildcard, inLabel whether its * at i matched a character, j the position in the pattern
+	type state struct {
+		i       int
+		inLabel bool
+		j       int
+	}
+	visited := make(map[state]bool)
+	var queue []state
+	var push func(st state)
+	push = func(st state) {
+		// Close over the empty moves: leaving a matched * label and skipping a * of the pattern
+		for {
+			if visited[st] {
+				return
+			}
+			visited[st] = true
+			queue = append(queue, st)
+			if st.inLabel {
+				push(state{st.i + 1, false, st.j})
+			}
+			if st.j < len(pattern) && pattern[st.j] == '*' {
+				st.j += 1
+				continue
+			}
+			return
+		}
+	}
+	push(state{0, false, 0})
+	for len(queue) > 0 {
+		st := queue[0]
+		queue = queue[1:]
+		if st.i == len(wildcard) && !st.inLabel && st.j == len(pattern) {
+			return true
+		}
+		for _, c := range alphabet {
+			var nexts []state
+			switch {
+			case st.inLabel:
+				if c != '.' {
+					nexts = append(nexts, state{st.i, true, 0})
+				}
+			case st.i < len(wildcard) && wildcard[st.i] == '*':
+				if c != '.' {
+					nexts = append(nexts, state{st.i, true, 0})
+				}
+			case st.i < len(wildcard) && wildcard[st.i] == c:
+				nexts = append(nexts, state{st.i + 1, false, 0})
+			}
+			for _, next := range nexts {
+				if st.j < len(pattern) && pattern[st.j] == '*' {
+					push(state{next.i, next.inLabel, st.j})
+				} else if st.j < len(pattern) && pattern[st.j] == c {
+					push(state{next.i, next.inLabel, st.j + 1})
+				}
+			}
+		}
+	}
+	return false
+}
+
+// owns reports whether a record is one of the owners of the rule
+func (o *owners) owns(record source.Record) bool {
+	if slices.Contains(o.projects, record.Labels["com.docker.compose.project"]) {
+		return true
+	}
+	if slices.ContainsFunc(o.labels, func(selector string) bool { return source.MatchLabel(selector, record.Labels) }) {
+		return true
+	}
+	return slices.ContainsFunc(o.names, func(re *regexp.Regexp) bool { return re.MatchString(record.Name) })
+}
+
+// checkOwnership drops and reports the binds claiming hostnames the record does not own
+func (g *Generator) checkOwnership(record source.Record, configs []SiteConfig) []SiteConfig {
+	var result []SiteConfig
+	for _, item := range configs {
+		if err := g.checkHostnames(record, item.Hostnames); err != nil {
+			log.Printf("Dropped bind of %s: %s", record.Name, err)
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+func (g *Generator) checkHostnames(record source.Record, hostnames []string) error {
+	if len(g.ownership) == 0 {
+		return nil
+	}
+	for _, hostname := range hostnames {
+		host, err := normalizeHostname(hostname)
+		if err != nil {
+			return err
+		}
+		for i := range g.ownership {
+			rule := &g.ownership[i]
+			if rule.claims(host) && !rule.owns(record) {
+				if strings.Contains(host, "*") {
+					return fmt.Errorf("hostname %s covers hostnames not owned by %s", hostname, record.Name)
+				}
+				return fmt.Errorf("hostname %s is not owned by %s", hostname, record.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeHostname returns the host of a site address without scheme, port and trailing dot,
+// so an address cannot escape the rules by spelling the same host differently
+func normalizeHostname(address string) (string, error) {
+	host := strings.ToLower(address)
+	if _, rest, found := strings.Cut(host, "://"); found {
+		host = rest
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimRight(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
+	if host == "" || strings.IndexFunc(host, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("-._*:", r))
+	}) >= 0 {
+		return "", fmt.Errorf("hostname %s cannot be checked against ownership rules", address)
+	}
+	return host, nil
+}
@@ -0,0 +1,223 @@
+package generator
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/secrets"
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// secretRule is a secret rule with compiled patterns
+type secretRule struct {
+	secrets []*regexp.Regexp
+	owners
+}
+
+// compileSecretRules compiles the secret rules of the default and project policies,
+// policies without secret rules allow all secrets and have no entry
+func compileSecretRules(policy *config.PolicyConfig) map[*config.PolicyConfig][]secretRule {
+	result := make(map[*config.PolicyConfig][]secretRule)
+	if policy == nil {
+		return result
+	}
+	for _, item := range append([]*config.PolicyConfig{policy}, mapValues(policy.Projects)...) {
+		if item == nil || item.Secrets == nil {
+			continue
+		}
+		rules := []secretRule{}
+		for _, rule := range item.Secrets {
+			compiled := secretRule{owners: compileOwners(rule.Projects, rule.Labels, rule.Names, "secret rule")}
+			for _, name := range rule.Secrets {
+				compiled.secrets = append(compiled.secrets, compileWildcard(name))
+			}
+			rules = append(rules, compiled)
+		}
+		result[item] = rules
+	}
+	return result
+}
+
+func mapValues[K comparable, V any](m map[K]V) []V {
+	var values []V
+	for _, value := range m {
+		values = append(values, value)
+	}
+	return values
+}
+
+// policyFor returns the policy of a record, project policies replace the default one
+func (g *Generator) policyFor(record source.Record) *config.PolicyConfig {
+	policy := g.config.Policy
+	if policy == nil {
+		return nil
+	}
+	if projectPolicy, exists := policy.Projects[record.Labels["com.docker.compose.project"]]; exists && projectPolicy != nil {
+		return projectPolicy
+	}
+	return policy
+}
+
+// policyRules returns the rules of a scope for a record
+func (g *Generator) policyRules(record source.Record, scope string) *config.DirectiveRules {
+	policy := g.policyFor(record)
+	if policy == nil {
+		return nil
+	}
+	if scope == "host" {
+		return policy.Host
+	}
+	return policy.Proxy
+}
+
+// checkPolicy verifies that the directives and secret references of a record are allowed
+func (g *Generator) checkPolicy(record source.Record, configs []SiteConfig) error {
+	hostRules := g.policyRules(record, "host")
+	proxyRules := g.policyRules(record, "proxy")
+	for _, item := range configs {
+		// TLS options are equivalent to a tls host directive
+		if item.TLS != "" {
+			if err := checkDirective(hostRules, "host", record, "tls"); err != nil {
+				return err
+			}
+		}
+		for _, directive := range item.HostDirectives {
+			if err := checkDirective(hostRules, "host", record, directive); err != nil {
+				return err
+			}
+		}
+		for _, directive := range item.ProxyDirectives {
+			if err := checkDirective(proxyRules, "proxy", record, directive); err != nil {
+				return err
+			}
+		}
+		if item.Scheme == schemeUnix {
+			if err := g.checkSocket(record, item.Target); err != nil {
+				return err
+			}
+		}
+		for _, name := range secrets.References(strings.Join(labelTexts(item), "\n")) {
+			if err := g.checkSecretAccess(record, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSecretAccess checks that a record is allowed to reference a secret
+func (g *Generator) checkSecretAccess(record source.Record, name string) error {
+	rules, exists := g.secretRules[g.policyFor(record)]
+	if !exists {
+		return nil
+	}
+	for _, rule := range rules {
+		matches := slices.ContainsFunc(rule.secrets, func(re *regexp.Regexp) bool { return re.MatchString(name) })
+		if matches && rule.owns(record) {
+			return nil
+		}
+	}
+	project := record.Labels["com.docker.compose.project"]
+	if project == "" {
+		return fmt.Errorf("secret %s is not allowed for %s by policy", name, record.Name)
+	}
+	return fmt.Errorf("secret %s is not allowed for %s by policy for project %s", name, record.Name, project)
+}
+
+// checkSocket checks that a record is allowed to proxy to a Unix socket,
+// sockets outside the directories of the policy are denied when a policy is set
+func (g *Generator) checkSocket(record source.Record, socket string) error {
+	policy := g.policyFor(record)
+	if policy == nil {
+		return nil
+	}
+	// Placeholders are resolved by Caddy and cannot be checked
+	if !strings.Contains(socket, "{") {
+		clean := path.Clean(socket)
+		for _, dir := range policy.Sockets {
+			dir = path.Clean(dir)
+			if dir == "/" || strings.HasPrefix(clean, dir+"/") {
+				return nil
+			}
+		}
+	}
+	project := record.Labels["com.docker.compose.project"]
+	if project == "" {
+		return fmt.Errorf("socket %s is not allowed for %s by policy", socket, record.Name)
+	}
+	return fmt.Errorf("socket %s is not allowed for %s by policy for project %s", socket, record.Name, project)
+}
+
+// labelTexts returns the parts of a site config that come from labels and may reference secrets
+func labelTexts(item SiteConfig) []string {
+	return slices.Concat(item.Hostnames, []string{item.PathMatcher, item.Target}, item.Transport, item.HostDirectives, item.ProxyDirectives)
+}
+
+// checkDirective checks the name of a directive against the allowlist,
+// and the names of the directive and of all directives nested in its block against the denylist
+func checkDirective(rules *config.DirectiveRules, scope string, record source.Record, directive string) error {
+	if rules == nil {
+		return nil
+	}
+	names := directiveNames(directive)
+	if len(names) == 0 {
+		return nil
+	}
+	if len(rules.Allow) > 0 && !slices.Contains(rules.Allow, names[0]) {
+		return policyError(names[0], scope, record)
+	}
+	for _, name := range names {
+		if slices.Contains(rules.Deny, name) {
+			return policyError(name, scope, record)
+		}
+	}
+	return nil
+}
+
+// directiveNames returns the first token of each line of a directive, named matchers are reported as @
+func directiveNames(directive string) []string {
+	var names []string
+	for _, line := range strings.Split(directive, "\n") {
+		tokens := lineTokens(line)
+		if len(tokens) == 0 || tokens[0] == "}" {
+			continue
+		}
+		name := unquoteToken(tokens[0])
+		if strings.HasPrefix(name, "@") {
+			name = "@"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// unquoteToken returns the value of a token as Caddy reads it, where a quoted token ends at its closing quote
+func unquoteToken(token string) string {
+	if token == "" || (token[0] != '"' && token[0] != '`') {
+		return token
+	}
+	quote := token[0]
+	var value strings.Builder
+	for i := 1; i < len(token); i++ {
+		switch {
+		case token[i] == quote:
+			return value.String()
+		case quote == '"' && token[i] == '\\' && i+1 < len(token) && token[i+1] == '"':
+			i += 1
+		}
+		value.WriteByte(token[i])
+	}
+	return value.String()
+}
+
+func policyError(name, scope string, record source.Record) error {
+	project := record.Labels["com.docker.compose.project"]
+	if project == "" {
+		return fmt.Errorf("directive %s is not allowed in %s scope by policy", name, scope)
+	}
+	return fmt.Errorf("directive %s is not allowed in %s scope by policy for project %s", name, scope, project)
+}
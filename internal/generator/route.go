@@ -0,0 +1,179 @@
+package generator
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// Kinds of routes besides reverse_proxy
+const (
+	routeRedir   = "redir"
+	routeRespond = "respond"
+)
+
+var (
+	statusPattern       = regexp.MustCompile(`^[1-5]\d\d$`)
+	redirectCodePattern = regexp.MustCompile(`^(3\d\d|permanent|temporary|html)$`)
+)
+
+// portAuto is the target port inferred from the image or the exposed ports
+const portAuto = "auto"
+
+// isBindTarget reports whether the first field of a line starts a new binding
+func isBindTarget(field string) bool {
+	if _, err := strconv.Atoi(field); err == nil || field == portAuto {
+		return true
+	}
+	for _, prefix := range []string{routeRedir, routeRespond, schemeHTTPS, schemeH2C, schemeUnix} {
+		if strings.HasPrefix(field, prefix+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRouteTarget parses the target of a bind line, i.e. [SCHEME:]PORT, [SCHEME:]auto, unix:PATH, redir:URL or respond:STATUS
+func (g *Generator) parseRouteTarget(record source.Record, target string, config *SiteConfig) error {
+	if url, found := strings.CutPrefix(target, routeRedir+":"); found {
+		if url == "" {
+			return fmt.Errorf("missing redirect target")
+		}
+		config.Route = routeRedir
+		config.Target = url
+		return nil
+	}
+	if status, found := strings.CutPrefix(target, routeRespond+":"); found {
+		if !statusPattern.MatchString(status) {
+			return fmt.Errorf("invalid status: %s", status)
+		}
+		config.Route = routeRespond
+		config.Status = status
+		return nil
+	}
+	if path, found := strings.CutPrefix(target, schemeUnix+":"); found {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid socket path: %s", path)
+		}
+		config.Scheme = schemeUnix
+		config.Target = path
+		return nil
+	}
+	for _, scheme := range []string{schemeHTTPS, schemeH2C} {
+		if port, found := strings.CutPrefix(target, scheme+":"); found {
+			// Only one scheme is stripped, a second one fails as an invalid port
+			config.Scheme = scheme
+			target = port
+			break
+		}
+	}
+	if target == portAuto {
+		if !record.Running() {
+			// Stopped containers list no ports, their routes are replaced later
+			return nil
+		}
+		port, err := g.inferPort(record)
+		if err != nil {
+			// Not wrapped so the error is not reported as skipped by auto-exposure
+			return fmt.Errorf("cannot infer port of %s: %v", record.Name, err)
+		}
+		target = strconv.Itoa(port)
+	}
+	port, _ := strconv.Atoi(target)
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port: %s", target)
+	}
+	if !record.Running() {
+		// Stopped containers have no address, their routes are replaced later
+		config.Port = port
+		return nil
+	}
+	var err error
+	config.ProxyIPs, config.Port, err = g.resolveUpstream(record, port, "tcp")
+	return err
+}
+
+// parseRouteOptions applies the key=value options of a bind line
+func parseRouteOptions(options map[string]string, config *SiteConfig) error {
+	// Options are applied in a stable order so transport blocks do not change between generations
+	for _, key := range slices.Sorted(maps.Keys(options)) {
+		value := options[key]
+		if _, exists := transportOptions[key]; exists {
+			if err := parseTransportOption(key, value, config); err != nil {
+				return err
+			}
+			continue
+		}
+		switch key {
+		case "code":
+			if config.Route != routeRedir || !redirectCodePattern.MatchString(value) {
+				return fmt.Errorf("invalid redirect code: %s", value)
+			}
+			config.Status = value
+		case "canonical":
+			if value != "www" && value != "apex" {
+				return fmt.Errorf("invalid canonical hostname: %s, want www or apex", value)
+			}
+		default:
+			return fmt.Errorf("unknown bind option: %s", key)
+		}
+	}
+	return nil
+}
+
+// canonicalize serves a route on the www or apex form of its hostnames only,
+// the other forms are redirected permanently
+func canonicalize(config SiteConfig, canonical string) ([]SiteConfig, error) {
+	var hostnames []string
+	var redirects []SiteConfig
+	for _, hostname := range config.Hostnames {
+		if strings.Contains(hostname, "*") {
+			return nil, fmt.Errorf("wildcard hostname cannot be canonicalized: %s", hostname)
+		}
+		apex := strings.TrimPrefix(hostname, "www.")
+		target, alias := apex, "www."+apex
+		if canonical == "www" {
+			target, alias = alias, target
+		}
+		if slices.Contains(hostnames, target) {
+			continue
+		}
+		hostnames = append(hostnames, target)
+		redirects = append(redirects, SiteConfig{
+			Name:      config.Name,
+			Hostnames: []string{alias},
+			Route:     routeRedir,
+			Target:    fmt.Sprintf("{scheme}://%s{uri}", target),
+			Status:    "permanent",
+		})
+	}
+	config.Hostnames = hostnames
+	return append([]SiteConfig{config}, redirects...), nil
+}
+
+// generateRouteDirectives renders redir and respond routes
+func (g *Generator) generateRouteDirectives(item SiteConfig) []string {
+	if item.Route == routeWake {
+		return g.generateWakeDirectives(item)
+	}
+	if item.Route == routeMaintenance {
+		return g.generateMaintenanceDirectives(item)
+	}
+	if item.Route == routeRedir {
+		return []string{strings.TrimRight(fmt.Sprintf("  redir %s %s %s", item.PathMatcher, item.Target, item.Status), " ")}
+	}
+	directives := g.expandSnippets(item.ProxyDirectives)
+	if len(directives) == 0 {
+		return []string{fmt.Sprintf("  respond %s %s", item.PathMatcher, item.Status)}
+	}
+	lines := []string{fmt.Sprintf("  respond %s %s {", item.PathMatcher, item.Status)}
+	for _, directive := range directives {
+		lines = append(lines, fmt.Sprintf("    %s", directive))
+	}
+	return append(lines, "  }")
+}
@@ -0,0 +1,69 @@
+package generator
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// snippetArgPattern matches the arguments of snippets, e.g. {args[0]}
+var snippetArgPattern = regexp.MustCompile(`\{args\[(\d+)\]\}`)
+
+// parseSnippet splits a directive referencing a snippet into the snippet name and arguments
+func parseSnippet(directive string) (string, []string, bool) {
+	if strings.Contains(directive, "\n") {
+		return "", nil, false
+	}
+	fields := strings.Fields(directive)
+	if len(fields) == 0 || fields[0] != "snippet" {
+		return "", nil, false
+	}
+	if len(fields) == 1 {
+		return "", nil, true
+	}
+	return fields[1], fields[2:], true
+}
+
+// checkSnippet verifies that a snippet directive references a known snippet with enough arguments
+func (g *Generator) checkSnippet(directive string) error {
+	name, args, ok := parseSnippet(directive)
+	if !ok {
+		return nil
+	}
+	if name == "" {
+		return fmt.Errorf("missing snippet name")
+	}
+	body, exists := g.config.Snippets[name]
+	if !exists {
+		return fmt.Errorf("unknown snippet: %s", name)
+	}
+	for _, line := range body {
+		for _, match := range snippetArgPattern.FindAllStringSubmatch(line, -1) {
+			index, _ := strconv.Atoi(match[1])
+			if index >= len(args) {
+				return fmt.Errorf("snippet %s needs argument %d", name, index)
+			}
+		}
+	}
+	return nil
+}
+
+// expandSnippets inlines the snippets referenced by directives
+func (g *Generator) expandSnippets(directives []string) []string {
+	var expanded []string
+	for _, directive := range directives {
+		name, args, ok := parseSnippet(directive)
+		if !ok {
+			expanded = append(expanded, directive)
+			continue
+		}
+		for _, line := range g.config.Snippets[name] {
+			expanded = append(expanded, snippetArgPattern.ReplaceAllStringFunc(line, func(match string) string {
+				index, _ := strconv.Atoi(snippetArgPattern.FindStringSubmatch(match)[1])
+				return args[index]
+			}))
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,89 @@
+package generator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// templatePattern matches template variables like {service} or {label.com.example.team}
+var templatePattern = regexp.MustCompile(`\{([a-z][a-z0-9_]*(?:\.[^{}\s]+)?)\}`)
+
+// envPattern matches references to environment variables of the target like ${PORT} or ${PORT:-3000}
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces references to environment variables of the target,
+// a variable that is not set and has no default is an error, an empty one takes the default if any
+func expandEnv(text string, env map[string]string) (string, error) {
+	var err error
+	result := envPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := envPattern.FindStringSubmatch(match)
+		value, exists := env[parts[1]]
+		if strings.Contains(match, ":-") && value == "" {
+			return parts[2]
+		}
+		if exists {
+			return value
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", parts[1])
+		}
+		return ""
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// templateVars collects the variables available to hostname templates of a container
+func (g *Generator) templateVars(record source.Record) map[string]string {
+	vars := map[string]string{
+		"name":    record.Name,
+		"service": record.Labels["com.docker.compose.service"],
+		"project": record.Labels["com.docker.compose.project"],
+		"domain":  g.config.DefaultDomain,
+	}
+	for key, value := range record.Labels {
+		vars["label."+key] = value
+	}
+	return vars
+}
+
+// expandTemplate replaces template variables, failing on unknown or empty ones
+func expandTemplate(tmpl string, vars map[string]string) (string, error) {
+	var err error
+	result := templatePattern.ReplaceAllStringFunc(tmpl, func(match string) string {
+		key := match[1 : len(match)-1]
+		value := vars[key]
+		if value == "" && err == nil {
+			err = fmt.Errorf("template variable %s is not set in %s", key, tmpl)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// expandHostnames expands hostname templates, falling back to the default hostname
+func (g *Generator) expandHostnames(hostnames []string, vars map[string]string) ([]string, error) {
+	if len(hostnames) == 0 {
+		if g.config.DefaultHost == "" {
+			return nil, fmt.Errorf("no hostname given and no default hostname configured")
+		}
+		hostnames = []string{g.config.DefaultHost}
+	}
+	var result []string
+	for _, hostname := range hostnames {
+		expanded, err := expandTemplate(hostname, vars)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
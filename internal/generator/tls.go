@@ -0,0 +1,100 @@
+package generator
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+)
+
+// TLS policies that can be set with the virtual.tls label, any other value refers to a named issuer
+const (
+	tlsInternal = "internal"
+	tlsOnDemand = "on_demand"
+	tlsHTTP     = "http"
+)
+
+// parseTLSPolicy validates the value of the virtual.tls label,
+// TLS is managed by the enclosing site in handle mode so a policy is an error there
+func (g *Generator) parseTLSPolicy(raw string) (string, error) {
+	policy := strings.TrimSpace(raw)
+	if policy == "" {
+		return "", nil
+	}
+	switch policy {
+	case tlsInternal, tlsOnDemand, tlsHTTP:
+	default:
+		if _, exists := g.config.TLSIssuers[policy]; !exists {
+			return "", fmt.Errorf("unknown TLS issuer: %s", policy)
+		}
+	}
+	if g.config.Mode != config.ModeSite {
+		return "", fmt.Errorf("TLS policy %s requires site mode", policy)
+	}
+	return policy, nil
+}
+
+// groupTLSPolicy returns the TLS policy shared by a group of site configs
+func (g *Generator) groupTLSPolicy(hostnames string, group []SiteConfig) string {
+	policy := ""
+	for _, item := range group {
+		if item.TLS == "" {
+			continue
+		}
+		if policy == "" {
+			policy = item.TLS
+		} else if policy != item.TLS {
+			log.Printf("Conflicting TLS policies for %s: %s, %s (using %s)", hostnames, policy, item.TLS, policy)
+		}
+	}
+	return policy
+}
+
+// siteAddress returns the address of a site block, forcing plain HTTP when required
+func (g *Generator) siteAddress(hostnames string, policy string) string {
+	if policy != tlsHTTP {
+		return hostnames
+	}
+	var addresses []string
+	for _, hostname := range strings.Fields(hostnames) {
+		addresses = append(addresses, "http://"+hostname)
+	}
+	return strings.Join(addresses, " ")
+}
+
+// generateTLSDirectives expands a TLS policy into the directives of a site block
+func (g *Generator) generateTLSDirectives(policy string) []string {
+	switch policy {
+	case "", tlsHTTP:
+		return nil
+	case tlsInternal:
+		return []string{"  tls internal"}
+	case tlsOnDemand:
+		return []string{"  tls {", "    on_demand", "  }"}
+	}
+	return generateIssuerDirectives(g.config.TLSIssuers[policy])
+}
+
+func generateIssuerDirectives(issuer config.TLSIssuer) []string {
+	var body []string
+	if issuer.CA != "" {
+		body = append(body, fmt.Sprintf("    ca %s", issuer.CA))
+	}
+	if issuer.DNS != "" {
+		body = append(body, fmt.Sprintf("    dns %s", issuer.DNS))
+	}
+	if len(issuer.Resolvers) > 0 {
+		body = append(body, fmt.Sprintf("    resolvers %s", strings.Join(issuer.Resolvers, " ")))
+	}
+	head := "  tls"
+	if issuer.Email != "" {
+		head += " " + issuer.Email
+	}
+	if len(body) == 0 {
+		return []string{head}
+	}
+	lines := []string{head + " {"}
+	lines = append(lines, body...)
+	return append(lines, "  }")
+}
@@ -0,0 +1,90 @@
+package generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schemes of upstreams besides plain HTTP
+const (
+	schemeHTTPS = "https"
+	schemeH2C   = "h2c"
+	schemeUnix  = "unix"
+)
+
+// Kinds of values of transport options
+const (
+	optionFlag     = "flag"
+	optionName     = "name"
+	optionDuration = "duration"
+)
+
+// transportOptions are the bind options rendered in the transport block of reverse_proxy
+var transportOptions = map[string]string{
+	"tls_insecure_skip_verify": optionFlag,
+	"tls_server_name":          optionName,
+	"dial_timeout":             optionDuration,
+	"read_timeout":             optionDuration,
+	"write_timeout":            optionDuration,
+	"response_header_timeout":  optionDuration,
+	"keepalive":                optionDuration,
+}
+
+// parseTransportOption validates a transport option of a bind line and adds it to the transport block
+func parseTransportOption(key, value string, config *SiteConfig) error {
+	if config.Route != "" {
+		return fmt.Errorf("transport option %s requires an upstream", key)
+	}
+	if strings.HasPrefix(key, "tls_") && config.Scheme != schemeHTTPS {
+		return fmt.Errorf("transport option %s requires an https upstream", key)
+	}
+	switch transportOptions[key] {
+	case optionFlag:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %s", key, value)
+		}
+		if enabled {
+			config.Transport = append(config.Transport, key)
+		}
+		return nil
+	case optionName:
+		if value == "" {
+			return fmt.Errorf("missing value of %s", key)
+		}
+	case optionDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid value of %s: %s", key, value)
+		}
+	}
+	config.Transport = append(config.Transport, fmt.Sprintf("%s %s", key, value))
+	return nil
+}
+
+// upstreamAddresses returns the addresses of the upstream in the to subdirective
+func upstreamAddresses(item SiteConfig) []string {
+	if item.Scheme == schemeUnix {
+		return []string{"unix/" + item.Target}
+	}
+	addresses := joinHostPort(item.ProxyIPs, item.Port)
+	if item.Scheme != "" {
+		for i, address := range addresses {
+			addresses[i] = fmt.Sprintf("%s://%s", item.Scheme, address)
+		}
+	}
+	return addresses
+}
+
+// generateTransport renders the transport block of an upstream
+func generateTransport(item SiteConfig) []string {
+	if len(item.Transport) == 0 {
+		return nil
+	}
+	lines := []string{"    transport http {"}
+	for _, option := range item.Transport {
+		lines = append(lines, fmt.Sprintf("      %s", option))
+	}
+	return append(lines, "    }")
+}
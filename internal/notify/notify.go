@@ -0,0 +1,195 @@
+// Package notify runs the notifiers telling Caddy and other services that the configuration changed.
+package notify
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/gera2ld/caddy-gen/internal/config"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	retryDelay     = 1 * time.Second
+)
+
+var defaultCommand = []string{"caddy", "reload"}
+
+// Docker runs commands in containers and signals them
+type Docker interface {
+	Exec(ctx context.Context, containerID string, options container.ExecOptions) (int, error)
+	Signal(ctx context.Context, containerID, signal string) error
+}
+
+// Chain runs notifiers in order
+type Chain struct {
+	notifiers []config.NotifyConfig
+	docker    Docker
+	client    *http.Client
+}
+
+// NewChain creates a chain of notifiers
+func NewChain(notifiers []config.NotifyConfig, docker Docker) *Chain {
+	return &Chain{
+		notifiers: notifiers,
+		docker:    docker,
+		client:    &http.Client{},
+	}
+}
+
+// Notify runs all notifiers in order, a failed notifier does not stop the following ones
+func (c *Chain) Notify() error {
+	var errs []error
+	for i, notifier := range c.notifiers {
+		log.Printf("Notify: %s", describe(notifier))
+		if err := c.run(notifier); err != nil {
+			log.Printf("Notifier %d failed: %v", i+1, err)
+			errs = append(errs, fmt.Errorf("notifier %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// run runs a notifier until an attempt succeeds or the retries are used up
+func (c *Chain) run(notifier config.NotifyConfig) error {
+	timeout := defaultTimeout
+	if notifier.Timeout > 0 {
+		timeout = time.Duration(notifier.Timeout) * time.Second
+	}
+	var err error
+	for attempt := 0; attempt <= notifier.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying %s after error: %v", notifier.Type, err)
+			time.Sleep(retryDelay)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = c.attempt(ctx, notifier)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *Chain) attempt(ctx context.Context, notifier config.NotifyConfig) error {
+	switch notifier.Type {
+	case config.NotifyExec:
+		code, err := c.docker.Exec(ctx, notifier.ContainerID, container.ExecOptions{
+			Cmd:        command(notifier),
+			WorkingDir: notifier.WorkingDir,
+			User:       notifier.User,
+			Env:        notifier.Env,
+		})
+		if err != nil {
+			return err
+		}
+		return checkExitCode(notifier, code)
+	case config.NotifySignal:
+		return c.docker.Signal(ctx, notifier.ContainerID, notifier.Signal)
+	case config.NotifyHTTP:
+		return c.request(ctx, notifier)
+	case config.NotifyCommand:
+		return runCommand(ctx, notifier)
+	}
+	return fmt.Errorf("unknown notifier type %q", notifier.Type)
+}
+
+// request sends the HTTP request of a notifier and checks its status
+func (c *Chain) request(ctx context.Context, notifier config.NotifyConfig) error {
+	method := cmp.Or(notifier.Method, http.MethodPost)
+	req, err := http.NewRequestWithContext(ctx, method, notifier.URL, strings.NewReader(notifier.Body))
+	if err != nil {
+		return err
+	}
+	for key, value := range notifier.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if len(notifier.Success) > 0 {
+		if !slices.Contains(notifier.Success, resp.StatusCode) {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// runCommand runs the local command of a notifier and checks its exit code
+func runCommand(ctx context.Context, notifier config.NotifyConfig) error {
+	args := command(notifier)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = notifier.WorkingDir
+	if len(notifier.Env) > 0 {
+		cmd.Env = append(os.Environ(), notifier.Env...)
+	}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return checkExitCode(notifier, exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	return checkExitCode(notifier, 0)
+}
+
+func command(notifier config.NotifyConfig) []string {
+	if len(notifier.Command) == 0 {
+		return defaultCommand
+	}
+	return notifier.Command
+}
+
+func checkExitCode(notifier config.NotifyConfig, code int) error {
+	success := notifier.Success
+	if len(success) == 0 {
+		success = []int{0}
+	}
+	if !slices.Contains(success, code) {
+		return fmt.Errorf("unexpected exit code %d", code)
+	}
+	return nil
+}
+
+// describe returns the target of a notifier for logs, leaving out the parts that may hold credentials
+func describe(notifier config.NotifyConfig) string {
+	switch notifier.Type {
+	case config.NotifyExec:
+		return fmt.Sprintf("exec %v in %s", command(notifier), notifier.ContainerID)
+	case config.NotifySignal:
+		return fmt.Sprintf("signal %s to %s", notifier.Signal, notifier.ContainerID)
+	case config.NotifyHTTP:
+		return fmt.Sprintf("http %s %s", cmp.Or(notifier.Method, http.MethodPost), redactURL(notifier.URL))
+	}
+	return fmt.Sprintf("command %v", command(notifier))
+}
+
+// redactURL hides the password and drops the query of a URL, which may hold tokens
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.Redacted()
+}
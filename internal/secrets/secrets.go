@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DockerSecretsDir is where Docker mounts the secrets of a container
+const DockerSecretsDir = "/run/secrets"
+
+// EnvPrefix is the prefix of environment variables that can be referenced as secrets
+const EnvPrefix = "CADDY_GEN_SECRET_"
+
+// namePattern matches secret names, which cannot contain path separators or start with a dot
+const namePattern = `[A-Za-z0-9_-][A-Za-z0-9_.-]*`
+
+// referencePattern matches secret references like {secret.api-token}
+var referencePattern = regexp.MustCompile(`\{secret\.(` + namePattern + `)\}`)
+
+var validNamePattern = regexp.MustCompile(`^` + namePattern + `$`)
+
+// Resolver looks up secrets in directories and in the environment of caddy-gen
+type Resolver struct {
+	Dirs []string // Directories holding one file per secret, searched in order
+}
+
+// NewResolver creates a resolver searching the Docker secrets and an optional extra directory
+func NewResolver(dir string) *Resolver {
+	dirs := []string{DockerSecretsDir}
+	if dir != "" {
+		dirs = append(dirs, dir)
+	}
+	return &Resolver{Dirs: dirs}
+}
+
+// References returns the names of the secrets referenced in a text
+func References(text string) []string {
+	var names []string
+	for _, match := range referencePattern.FindAllStringSubmatch(text, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// Lookup returns the value of a secret, errors never contain the value
+func (r *Resolver) Lookup(name string) (string, error) {
+	for _, dir := range r.Dirs {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return validate(name, strings.TrimRight(string(data), "\r\n"))
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read secret %s: %v", name, err)
+		}
+	}
+	if value, exists := os.LookupEnv(envName(name)); exists {
+		return validate(name, value)
+	}
+	return "", fmt.Errorf("secret %s not found", name)
+}
+
+// ReadFile returns the content of a secret file, e.g. a list of users
+func (r *Resolver) ReadFile(name string) (string, error) {
+	if !validNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid secret name %s", name)
+	}
+	for _, dir := range r.Dirs {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(data), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read secret %s: %v", name, err)
+		}
+	}
+	return "", fmt.Errorf("secret file %s not found", name)
+}
+
+// Check verifies that all secrets referenced in a text can be resolved
+func (r *Resolver) Check(text string) error {
+	for _, name := range References(text) {
+		if _, err := r.Lookup(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expand replaces secret references in a text with their values
+func (r *Resolver) Expand(text string) (string, error) {
+	var err error
+	result := referencePattern.ReplaceAllStringFunc(text, func(match string) string {
+		name := referencePattern.FindStringSubmatch(match)[1]
+		value, lookupErr := r.Lookup(name)
+		if lookupErr != nil && err == nil {
+			err = lookupErr
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// envName maps a secret name to the environment variable holding it, e.g. api-token to CADDY_GEN_SECRET_API_TOKEN
+func envName(name string) string {
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	return EnvPrefix + strings.ToUpper(name)
+}
+
+// validate rejects values that would break out of a Caddyfile token
+func validate(name, value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n{}") {
+		return "", fmt.Errorf("secret %s contains a line break or brace", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolver(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "api-token"), []byte("s3cr3t\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "broken"), []byte("line1\nline2\n"), 0600)
+	t.Setenv("CADDY_GEN_SECRET_DB_PASSWORD", "p4ss")
+	t.Setenv("OTHER_SECRET", "hidden")
+	resolver := &Resolver{Dirs: []string{filepath.Join(dir, "missing"), dir}}
+
+	// Test file secret
+	value, err := resolver.Lookup("api-token")
+	if err != nil || value != "s3cr3t" {
+		t.Errorf("Lookup(api-token) = %q, %v; want s3cr3t", value, err)
+	}
+
+	// Test environment secret
+	value, err = resolver.Lookup("db.password")
+	if err != nil || value != "p4ss" {
+		t.Errorf("Lookup(db.password) = %q, %v; want p4ss", value, err)
+	}
+
+	// Test variables without prefix and invalid values
+	if _, err := resolver.Lookup("OTHER_SECRET"); err == nil {
+		t.Errorf("Lookup(OTHER_SECRET) returned no error")
+	}
+	if _, err := resolver.Lookup("broken"); err == nil || strings.Contains(err.Error(), "line1") {
+		t.Errorf("Lookup(broken) = %v; want error without value", err)
+	}
+
+	// Test expansion
+	text := `header_up Authorization "Bearer {secret.api-token}"`
+	if names := References(text); len(names) != 1 || names[0] != "api-token" {
+		t.Errorf("References() = %v; want [api-token]", names)
+	}
+	expanded, err := resolver.Expand(text)
+	if err != nil || expanded != `header_up Authorization "Bearer s3cr3t"` {
+		t.Errorf("Expand() = %q, %v; want token replaced", expanded, err)
+	}
+	if err := resolver.Check("{secret.missing} {env.HOME}"); err == nil {
+		t.Errorf("Check() with missing secret returned no error")
+	}
+
+	// Path traversal is not a valid reference
+	if names := References("{secret.../etc/passwd}"); len(names) != 0 {
+		t.Errorf("References() = %v; want no reference", names)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "users"), []byte("alice hash\n"), 0600)
+	resolver := NewResolver(dir)
+
+	if content, err := resolver.ReadFile("users"); err != nil || content != "alice hash\n" {
+		t.Errorf("ReadFile(users) = %q, %v; want file content", content, err)
+	}
+	for _, name := range []string{"missing", "../users", ""} {
+		if _, err := resolver.ReadFile(name); err == nil {
+			t.Errorf("ReadFile(%q) = nil error; want error", name)
+		}
+	}
+}
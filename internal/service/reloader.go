@@ -0,0 +1,68 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// reloader rate limits reloads, changes within the interval after a reload are folded into the next one
+type reloader struct {
+	notify   func()
+	interval time.Duration
+
+	mu        sync.Mutex
+	notifyMu  sync.Mutex // Serializes scheduled and forced reloads
+	last      time.Time  // Time of the last reload
+	pending   int        // Changed generations not reloaded yet
+	scheduled bool       // Whether a delayed reload is waiting for the interval to pass
+}
+
+func newReloader(notify func(), interval time.Duration) *reloader {
+	return &reloader{notify: notify, interval: interval}
+}
+
+// Request records a changed generation and reloads if the interval has passed,
+// otherwise the reload is delayed until then, forced requests reload immediately
+func (r *reloader) Request(force bool) {
+	r.mu.Lock()
+	r.pending += 1
+	wait := r.interval - time.Since(r.last)
+	if !force && wait > 0 {
+		if !r.scheduled {
+			r.scheduled = true
+			time.AfterFunc(wait, r.scheduledReload)
+		}
+		log.Printf("Reload delayed by %s, %d changed generation(s) pending", wait.Round(time.Millisecond), r.pending)
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+	r.reload()
+}
+
+func (r *reloader) scheduledReload() {
+	r.mu.Lock()
+	r.scheduled = false
+	r.mu.Unlock()
+	r.reload()
+}
+
+// reload notifies once for all pending generations
+func (r *reloader) reload() {
+	r.notifyMu.Lock()
+	defer r.notifyMu.Unlock()
+	r.mu.Lock()
+	folded := r.pending
+	r.pending = 0
+	if folded > 0 {
+		r.last = time.Now()
+	}
+	r.mu.Unlock()
+	if folded == 0 {
+		// A forced reload took the pending generations already
+		return
+	}
+	log.Printf("Reloading, folded %d changed generation(s)", folded)
+	r.notify()
+}
@@ -5,11 +5,15 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gera2ld/caddy-gen/internal/config"
 	"github.com/gera2ld/caddy-gen/internal/docker"
 	"github.com/gera2ld/caddy-gen/internal/generator"
+	"github.com/gera2ld/caddy-gen/internal/notify"
+	"github.com/gera2ld/caddy-gen/internal/source"
+	"github.com/gera2ld/caddy-gen/internal/waker"
 )
 
 const banner = "# Generated by Caddy-gen at "
@@ -17,55 +21,104 @@ const banner = "# Generated by Caddy-gen at "
 // Service is the main service
 type Service struct {
 	docker    *docker.Client
+	source    source.Source
 	generator *generator.Generator
+	waker     *waker.Waker
+	notifier  *notify.Chain
+	reloader  *reloader
 	config    *config.Config
+
+	mu sync.Mutex // Serializes config updates from events and the waker
 }
 
 // NewService creates a new Service
 func NewService() (*Service, error) {
-	cfg := config.NewConfig()
+	cfg, err := config.NewConfig()
+	if err != nil {
+		return nil, err
+	}
 	dockerClient, err := docker.NewClient(cfg)
 	if err != nil {
 		return nil, err
 	}
 	gen := generator.NewGenerator(dockerClient, cfg)
-	return &Service{
+	s := &Service{
 		docker:    dockerClient,
+		source:    dockerClient,
 		generator: gen,
+		notifier:  notify.NewChain(cfg.Notify, dockerClient),
 		config:    cfg,
-	}, nil
+	}
+	s.reloader = newReloader(s.notifyConfigChange, time.Duration(cfg.ReloadInterval)*time.Second)
+	if cfg.Waker != nil {
+		// Woken containers must be routed before the client retries, so the reload is not delayed
+		s.waker = waker.NewWaker(dockerClient, dockerClient, cfg.Waker, s.checkConfigNow)
+	}
+	return s, nil
 }
 
 // Close closes the service
 func (s *Service) Close() error {
-	return s.docker.Close()
+	if s.waker != nil {
+		s.waker.Close()
+	}
+	return s.source.Close()
 }
 
 // Run runs the service
 func (s *Service) Run() error {
 	s.CheckConfig()
+	if s.waker != nil {
+		go func() {
+			if err := s.waker.Run(); err != nil {
+				log.Printf("Waker error: %v", err)
+			}
+		}()
+	}
 	log.Println("Waiting for Docker events...")
-	s.docker.WatchEvents(s.CheckConfig)
+	s.source.WatchEvents(s.CheckConfig)
 	return nil
 }
 
-// CheckConfig checks and updates the configuration
+// CheckConfig checks and updates the configuration, reloads are rate limited
 func (s *Service) CheckConfig() {
-	currentConfig := stripBanner(s.readConfig(s.config.OutFile))
-	newConfig, err := s.generator.GenerateConfig()
+	s.checkConfig(false)
+}
+
+// checkConfigNow checks and updates the configuration, reloading immediately on changes
+func (s *Service) checkConfigNow() {
+	s.checkConfig(true)
+}
+
+func (s *Service) checkConfig(force bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	output, err := s.generator.Generate()
 	if err != nil {
 		log.Printf("Failed to generate config: %v", err)
 		return
 	}
-	if currentConfig != newConfig {
-		newConfig = generateBanner() + newConfig
-		s.writeConfig(s.config.OutFile, newConfig)
-		s.notifyConfigChange()
+	changed := s.updateConfig(s.config.OutFile, output.Sites)
+	if s.config.L4OutFile != "" {
+		changed = s.updateConfig(s.config.L4OutFile, output.L4) || changed
+	}
+	if changed {
+		s.reloader.Request(force)
 	} else {
 		log.Println("No change, skip notifying")
 	}
 }
 
+// updateConfig writes a configuration file if its content changed
+func (s *Service) updateConfig(filePath, newConfig string) bool {
+	currentConfig := stripBanner(s.readConfig(filePath))
+	if currentConfig == newConfig {
+		return false
+	}
+	s.writeConfig(filePath, generateBanner()+newConfig)
+	return true
+}
+
 func generateBanner() string {
 	timestamp := time.Now().Format(time.RFC3339)
 	return fmt.Sprintf("%s %s\n\n", banner, timestamp)
@@ -101,5 +154,7 @@ func (s *Service) writeConfig(filePath, config string) {
 
 // notifyConfigChange notifies that the configuration has changed
 func (s *Service) notifyConfigChange() {
-	s.docker.Notify()
+	if err := s.notifier.Notify(); err != nil {
+		log.Printf("Failed to notify config change: %v", err)
+	}
 }
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/gera2ld/caddy-gen/internal/docker/dockertest"
+)
+
+func newTestContainer(id, ip string, labels map[string]string) container.Summary {
+	return container.Summary{
+		ID:     id,
+		Names:  []string{"/" + id},
+		Labels: labels,
+		State:  "running",
+		NetworkSettings: &container.NetworkSettingsSummary{
+			Networks: map[string]*network.EndpointSettings{
+				"gateway": {IPAddress: ip},
+			},
+		},
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	caddy := newTestContainer("caddy", "172.17.0.2", map[string]string{})
+	web := newTestContainer("web", "172.17.0.3", map[string]string{"virtual.bind": "80 web.example.com"})
+	api := newTestContainer("api", "172.17.0.4", map[string]string{"virtual.bind": "8080 api.example.com"})
+	srv.SetContainers(caddy, web)
+
+	outFile := filepath.Join(t.TempDir(), "docker-sites.caddy")
+	t.Setenv("CADDY_GEN_ENDPOINTS", fmt.Sprintf(`[{"host":%q}]`, srv.Host()))
+	t.Setenv("CADDY_GEN_OUTFILE", outFile)
+	t.Setenv("CADDY_GEN_NOTIFY", `{"containerId":"caddy","workingDir":"/etc/caddy"}`)
+	t.Setenv("CADDY_GEN_RELOAD_INTERVAL", "0")
+	svc, err := NewService()
+	if err != nil {
+		t.Fatalf("NewService() error: %s", err)
+	}
+	defer svc.Close()
+
+	// Test initial generation
+	svc.CheckConfig()
+	data, _ := os.ReadFile(outFile)
+	if !strings.HasPrefix(string(data), banner) || !strings.Contains(string(data), "to 172.17.0.3:80") {
+		t.Errorf("config = %s; want banner and web upstream", data)
+	}
+	if execs := srv.Execs(); len(execs) != 1 || execs[0].ContainerID != "caddy" {
+		t.Errorf("Execs() = %+v; want 1 exec in caddy", execs)
+	}
+
+	// Test unchanged config
+	svc.CheckConfig()
+	if execs := srv.Execs(); len(execs) != 1 {
+		t.Errorf("Execs() = %+v; want no new exec", execs)
+	}
+
+	// Test watch, generate, write and notify cycle
+	go svc.Run()
+	waitFor(t, func() bool { return srv.Subscribers() == 1 })
+	srv.SetContainers(caddy, web, api)
+	srv.EmitContainer("start", api)
+	waitFor(t, func() bool { return len(srv.Execs()) == 2 })
+	data, _ = os.ReadFile(outFile)
+	if !strings.Contains(string(data), "to 172.17.0.4:8080") {
+		t.Errorf("config = %s; want api upstream", data)
+	}
+}
+
+func TestCheckL4Config(t *testing.T) {
+	srv := dockertest.NewServer(t)
+	caddy := newTestContainer("caddy", "172.17.0.2", map[string]string{})
+	db := newTestContainer("db", "172.17.0.3", map[string]string{"virtual.l4": "5432 5432"})
+	srv.SetContainers(caddy)
+
+	dir := t.TempDir()
+	l4File := filepath.Join(dir, "docker-l4.caddy")
+	t.Setenv("CADDY_GEN_ENDPOINTS", fmt.Sprintf(`[{"host":%q}]`, srv.Host()))
+	t.Setenv("CADDY_GEN_OUTFILE", filepath.Join(dir, "docker-sites.caddy"))
+	t.Setenv("CADDY_GEN_L4_OUTFILE", l4File)
+	t.Setenv("CADDY_GEN_NOTIFY", `{"containerId":"caddy","workingDir":"/etc/caddy"}`)
+	svc, err := NewService()
+	if err != nil {
+		t.Fatalf("NewService() error: %s", err)
+	}
+	defer svc.Close()
+
+	svc.CheckConfig()
+	if data, _ := os.ReadFile(l4File); stripBanner(string(data)) != "" {
+		t.Errorf("L4 config = %s; want empty config", data)
+	}
+
+	// A change of L4 routes only is notified as well
+	srv.SetContainers(caddy, db)
+	svc.CheckConfig()
+	data, _ := os.ReadFile(l4File)
+	if !strings.Contains(string(data), "proxy 172.17.0.3:5432") {
+		t.Errorf("L4 config = %s; want db upstream", data)
+	}
+	if execs := srv.Execs(); len(execs) != 1 {
+		t.Errorf("Execs() = %+v; want 1 exec", execs)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	var mu sync.Mutex
+	reloads := 0
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return reloads
+	}
+	r := newReloader(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		reloads += 1
+	}, 200*time.Millisecond)
+
+	// The first change reloads immediately, a burst of changes is folded into one reload
+	r.Request(false)
+	if count() != 1 {
+		t.Fatalf("reloads = %d; want 1", count())
+	}
+	for range 5 {
+		r.Request(false)
+	}
+	if count() != 1 {
+		t.Errorf("reloads = %d; want reloads delayed by the interval", count())
+	}
+	waitFor(t, func() bool { return count() == 2 })
+
+	// Forced reloads are not delayed and take the pending changes
+	r.Request(false)
+	r.Request(true)
+	if count() != 3 {
+		t.Errorf("reloads = %d; want a forced reload", count())
+	}
+	time.Sleep(300 * time.Millisecond)
+	if count() != 3 {
+		t.Errorf("reloads = %d; want no other reload after the folded and forced ones", count())
+	}
+}
+
+func TestStripBanner(t *testing.T) {
+	config := "handle {\n}"
+	if result := stripBanner(generateBanner() + config); result != config {
+		t.Errorf("stripBanner() = %q; want %q", result, config)
+	}
+	if result := stripBanner(config); result != config {
+		t.Errorf("stripBanner() = %q; want %q", result, config)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,54 @@
+package source
+
+import "sync"
+
+// Memory is an in-memory source, e.g. for tests
+type Memory struct {
+	mu        sync.Mutex
+	records   []Record
+	callbacks []func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemory creates a new Memory source with initial records
+func NewMemory(records ...Record) *Memory {
+	return &Memory{
+		records: records,
+		done:    make(chan struct{}),
+	}
+}
+
+// Records returns the current records
+func (m *Memory) Records() ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Record(nil), m.records...), nil
+}
+
+// Set replaces the records and notifies the watchers
+func (m *Memory) Set(records ...Record) {
+	m.mu.Lock()
+	m.records = records
+	callbacks := append([]func(){}, m.callbacks...)
+	m.mu.Unlock()
+	for _, callback := range callbacks {
+		callback()
+	}
+}
+
+// WatchEvents registers the callback and blocks until the source is closed
+func (m *Memory) WatchEvents(callback func()) {
+	m.mu.Lock()
+	m.callbacks = append(m.callbacks, callback)
+	m.mu.Unlock()
+	<-m.done
+}
+
+// Close stops watching
+func (m *Memory) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
@@ -0,0 +1,48 @@
+package source
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	src := NewMemory(Record{Name: "web"})
+	records, err := src.Records()
+	if err != nil || len(records) != 1 || records[0].Name != "web" {
+		t.Errorf("Records() = %v, %v; want [web]", records, err)
+	}
+
+	notified := make(chan struct{}, 1)
+	watching := make(chan struct{})
+	go func() {
+		src.WatchEvents(func() { notified <- struct{}{} })
+		close(watching)
+	}()
+
+	// Wait for the callback to be registered
+	for {
+		src.mu.Lock()
+		registered := len(src.callbacks) > 0
+		src.mu.Unlock()
+		if registered {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	src.Set()
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Set() did not notify the watcher")
+	}
+	if records, _ := src.Records(); len(records) != 0 {
+		t.Errorf("Records() = %v; want no record", records)
+	}
+
+	src.Close()
+	select {
+	case <-watching:
+	case <-time.After(time.Second):
+		t.Fatal("WatchEvents() did not return after Close()")
+	}
+}
@@ -0,0 +1,66 @@
+package source
+
+import (
+	"context"
+	"strings"
+)
+
+// Source yields route records and notifies when they may have changed
+type Source interface {
+	// Records returns the current route records
+	Records() ([]Record, error)
+	// WatchEvents blocks and calls the callback function whenever records may have changed
+	WatchEvents(callback func())
+	// Close releases the resources of the source and stops watching
+	Close() error
+}
+
+// Controller is implemented by sources that can start and stop their targets
+type Controller interface {
+	// Start starts a target and blocks until it is running and healthy
+	Start(ctx context.Context, record Record) error
+	// Stop stops a target
+	Stop(ctx context.Context, record Record) error
+	// Traffic returns the total bytes received by a running target
+	Traffic(ctx context.Context, record Record) (uint64, error)
+}
+
+// Record is a normalized route record of a target such as a container
+type Record struct {
+	Name        string            // Name of the target, used in comments and templates
+	Labels      map[string]string // Labels holding the virtual.* options
+	Image       string            // Image of the target, e.g. nginx:alpine
+	Origin      string            // Name of the source or endpoint yielding the record
+	IP          string            // IPv4 address of the target on the monitored network
+	IPv6        string            // IPv6 address of the target on the monitored network
+	HostAddress string            // Address to reach published ports, used instead of IP if set
+	HostNetwork bool              // Target shares the network of the host, its ports are reached at HostAddress
+	Ports       []Port            // Exposed ports of the target
+	Env         map[string]string // Environment variables of the target, nil if not fetched
+	State       string            // State of the target, e.g. running or exited, empty if always running
+}
+
+// StateRunning is the state of targets that can receive requests
+const StateRunning = "running"
+
+// Running reports whether the target can receive requests
+func (r Record) Running() bool {
+	return r.State == "" || r.State == StateRunning
+}
+
+// Port is an exposed port of a target
+type Port struct {
+	Private  int    // Port inside the target
+	Public   int    // Published port on the host, 0 if not published
+	Protocol string // Either tcp or udp
+}
+
+// MatchLabel matches a KEY or KEY=VALUE selector against labels
+func MatchLabel(selector string, labels map[string]string) bool {
+	key, value, hasValue := strings.Cut(selector, "=")
+	actual, exists := labels[key]
+	if !exists {
+		return false
+	}
+	return !hasValue || actual == value
+}
@@ -0,0 +1,256 @@
+// Package waker starts stopped containers on their first request and stops them again when idle.
+package waker
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// Headers set by Caddy on the requests forwarded to the waker
+const (
+	NameHeader   = "X-Caddy-Gen-Name"
+	OriginHeader = "X-Caddy-Gen-Origin"
+	TokenHeader  = "X-Caddy-Gen-Token"
+)
+
+// Labels of containers started on demand
+const (
+	wakeLabel        = "virtual.wake"
+	idleTimeoutLabel = "virtual.idle_timeout"
+)
+
+// idleInterval is the delay between checks of the traffic of running containers
+const idleInterval = time.Minute
+
+// Waker serves the requests of stopped containers and stops idle ones
+type Waker struct {
+	source     source.Source
+	controller source.Controller
+	config     *config.WakerConfig
+	regenerate func()
+	interval   time.Duration
+	server     *http.Server
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mu       sync.Mutex
+	starting map[string]*start
+	activity map[string]*activity
+}
+
+// start is a pending start of a container shared by concurrent requests
+type start struct {
+	done chan struct{}
+	err  error
+}
+
+// activity is the traffic of a container when it last changed
+type activity struct {
+	rxBytes uint64
+	since   time.Time
+}
+
+// NewWaker creates a waker, regenerate is called once a container is started
+func NewWaker(src source.Source, controller source.Controller, cfg *config.WakerConfig, regenerate func()) *Waker {
+	w := &Waker{
+		source:     src,
+		controller: controller,
+		config:     cfg,
+		regenerate: regenerate,
+		interval:   idleInterval,
+		done:       make(chan struct{}),
+		starting:   make(map[string]*start),
+		activity:   make(map[string]*activity),
+	}
+	w.server = &http.Server{Addr: cfg.Listen, Handler: w}
+	return w
+}
+
+// Enabled reports whether a container is started on demand
+func Enabled(record source.Record) bool {
+	enabled, err := strconv.ParseBool(record.Labels[wakeLabel])
+	return err == nil && enabled
+}
+
+// idleTimeout returns the period without traffic after which a container is stopped, 0 to keep it running
+func idleTimeout(record source.Record) time.Duration {
+	raw, exists := record.Labels[idleTimeoutLabel]
+	if !exists {
+		return 0
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout < 0 {
+		log.Printf("Invalid idle timeout of %s: %s", record.Name, raw)
+		return 0
+	}
+	return timeout
+}
+
+func recordKey(record source.Record) string {
+	return record.Origin + "/" + record.Name
+}
+
+// Run serves the waker endpoint and stops idle containers, it blocks until the waker is closed
+func (w *Waker) Run() error {
+	go w.watchIdle()
+	log.Printf("Waker listening on %s", w.config.Listen)
+	err := w.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving and watching
+func (w *Waker) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return w.server.Close()
+}
+
+// ServeHTTP starts the container a request is meant for, then redirects the client to the same URL
+func (w *Waker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Only requests forwarded by Caddy carry the token, others could start any opted-in container
+	token := r.Header.Get(TokenHeader)
+	if w.config.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(w.config.Token)) != 1 {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	record, err := w.findRecord(r.Header.Get(OriginHeader), r.Header.Get(NameHeader))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := w.wake(r.Context(), record); err != nil {
+		log.Printf("Failed to wake up %s: %v", record.Name, err)
+		http.Error(rw, fmt.Sprintf("Failed to start %s", record.Name), http.StatusServiceUnavailable)
+		return
+	}
+	// Caddy proxies to the container from now on
+	http.Redirect(rw, r, r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// findRecord finds a stopped container that can be started on demand
+func (w *Waker) findRecord(origin, name string) (source.Record, error) {
+	records, err := w.source.Records()
+	if err != nil {
+		return source.Record{}, err
+	}
+	for _, record := range records {
+		if record.Name == name && record.Origin == origin && Enabled(record) {
+			return record, nil
+		}
+	}
+	return source.Record{}, fmt.Errorf("no container %s to wake up", name)
+}
+
+// wake starts a container once for all concurrent requests and waits until it is ready
+func (w *Waker) wake(ctx context.Context, record source.Record) error {
+	key := recordKey(record)
+	w.mu.Lock()
+	pending, exists := w.starting[key]
+	if !exists {
+		pending = &start{done: make(chan struct{})}
+		w.starting[key] = pending
+		go w.start(record, pending)
+	}
+	w.mu.Unlock()
+	select {
+	case <-pending.done:
+		return pending.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Waker) start(record source.Record, pending *start) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(w.config.Timeout)*time.Second)
+	defer cancel()
+	log.Printf("Waking up %s", record.Name)
+	pending.err = w.controller.Start(ctx, record)
+	if pending.err == nil {
+		w.regenerate()
+	}
+	key := recordKey(record)
+	w.mu.Lock()
+	delete(w.starting, key)
+	// The idle period starts when the container is up
+	delete(w.activity, key)
+	w.mu.Unlock()
+	close(pending.done)
+}
+
+func (w *Waker) watchIdle() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.checkIdle()
+		}
+	}
+}
+
+// checkIdle stops the containers whose received bytes did not change during their idle timeout
+func (w *Waker) checkIdle() {
+	records, err := w.source.Records()
+	if err != nil {
+		log.Printf("Failed to check idle containers: %v", err)
+		return
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, record := range records {
+		timeout := idleTimeout(record)
+		if !record.Running() || !Enabled(record) || timeout == 0 {
+			continue
+		}
+		key := recordKey(record)
+		seen[key] = true
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		rxBytes, err := w.controller.Traffic(ctx, record)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to get traffic of %s: %v", record.Name, err)
+			continue
+		}
+		w.mu.Lock()
+		last := w.activity[key]
+		if last == nil || last.rxBytes != rxBytes {
+			w.activity[key] = &activity{rxBytes: rxBytes, since: now}
+			w.mu.Unlock()
+			continue
+		}
+		idle := now.Sub(last.since) >= timeout
+		if idle {
+			delete(w.activity, key)
+		}
+		w.mu.Unlock()
+		if idle {
+			log.Printf("Stopping %s after %s without traffic", record.Name, timeout)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := w.controller.Stop(ctx, record); err != nil {
+				log.Printf("Failed to stop %s: %v", record.Name, err)
+			}
+			cancel()
+		}
+	}
+	w.mu.Lock()
+	for key := range w.activity {
+		if !seen[key] {
+			delete(w.activity, key)
+		}
+	}
+	w.mu.Unlock()
+}
@@ -0,0 +1,129 @@
+package waker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gera2ld/caddy-gen/internal/config"
+	"github.com/gera2ld/caddy-gen/internal/source"
+)
+
+// fakeController starts and stops the records of a memory source
+type fakeController struct {
+	src     *source.Memory
+	mu      sync.Mutex
+	starts  int
+	stops   []string
+	rxBytes uint64
+}
+
+func (c *fakeController) setState(record source.Record, state string) {
+	records, _ := c.src.Records()
+	for i := range records {
+		if records[i].Name == record.Name {
+			records[i].State = state
+		}
+	}
+	c.src.Set(records...)
+}
+
+func (c *fakeController) Start(ctx context.Context, record source.Record) error {
+	c.mu.Lock()
+	c.starts++
+	c.mu.Unlock()
+	c.setState(record, source.StateRunning)
+	return nil
+}
+
+func (c *fakeController) Stop(ctx context.Context, record source.Record) error {
+	c.mu.Lock()
+	c.stops = append(c.stops, record.Name)
+	c.mu.Unlock()
+	c.setState(record, "exited")
+	return nil
+}
+
+func (c *fakeController) Traffic(ctx context.Context, record source.Record) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rxBytes, nil
+}
+
+func TestServeHTTP(t *testing.T) {
+	src := source.NewMemory(
+		source.Record{Name: "tool", Origin: "local", Labels: map[string]string{"virtual.wake": "true"}, State: "exited"},
+		source.Record{Name: "other", Origin: "local", Labels: map[string]string{}, State: "exited"},
+	)
+	controller := &fakeController{src: src}
+	var regenerations atomic.Int32
+	w := NewWaker(src, controller, &config.WakerConfig{Timeout: 5, Token: "secret"}, func() { regenerations.Add(1) })
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/docs?page=2", nil)
+			req.Header.Set(NameHeader, "tool")
+			req.Header.Set(OriginHeader, "local")
+			req.Header.Set(TokenHeader, "secret")
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, req)
+			if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "/docs?page=2" {
+				t.Errorf("ServeHTTP() = %d %s; want redirect to /docs?page=2", rec.Code, rec.Header().Get("Location"))
+			}
+		}()
+	}
+	wg.Wait()
+	if controller.starts > 5 || controller.starts < 1 || regenerations.Load() != int32(controller.starts) {
+		t.Errorf("starts = %d, regenerations = %d; want one regeneration per start", controller.starts, regenerations.Load())
+	}
+
+	// Containers that are not opted in cannot be started
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(NameHeader, "other")
+	req.Header.Set(OriginHeader, "local")
+	req.Header.Set(TokenHeader, "secret")
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("ServeHTTP(other) = %d; want 404", rec.Code)
+	}
+
+	// Requests without the token of Caddy are rejected before looking up the container
+	starts := controller.starts
+	for _, token := range []string{"", "wrong"} {
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(NameHeader, "tool")
+		req.Header.Set(OriginHeader, "local")
+		req.Header.Set(TokenHeader, token)
+		rec = httptest.NewRecorder()
+		w.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden || controller.starts != starts {
+			t.Errorf("ServeHTTP(%q) = %d; want 403 without start", token, rec.Code)
+		}
+	}
+}
+
+func TestCheckIdle(t *testing.T) {
+	src := source.NewMemory(
+		source.Record{Name: "tool", Labels: map[string]string{"virtual.wake": "true", "virtual.idle_timeout": "1ns"}, State: "running"},
+		source.Record{Name: "busy", Labels: map[string]string{"virtual.wake": "true"}, State: "running"},
+	)
+	controller := &fakeController{src: src, rxBytes: 100}
+	w := NewWaker(src, controller, &config.WakerConfig{Timeout: 5}, func() {})
+
+	// The first check records the traffic, the second one finds it unchanged
+	w.checkIdle()
+	if len(controller.stops) != 0 {
+		t.Fatalf("stops = %v; want none after the first check", controller.stops)
+	}
+	w.checkIdle()
+	if len(controller.stops) != 1 || controller.stops[0] != "tool" {
+		t.Errorf("stops = %v; want [tool]", controller.stops)
+	}
+}